@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Period is a weekly recurring time range.
+type Period struct {
+	Days  string // eg. "Mon-Fri" or "Sat,Sun", every day if empty
+	Hours string // eg. "08:00-18:00", may wrap midnight, all day if empty
+}
+
+// BandwidthRule is a bandwidth limit used during a period.
+type BandwidthRule struct {
+	Period
+	Limit string // bytes/s, eg. "2M", unlimited if empty or "0"
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// period is a parsed Period.
+type period struct {
+	days       [7]bool
+	start, end int // minutes from midnight
+}
+
+func parseperiod(p Period) (*period, error) {
+	r := &period{start: 0, end: 24 * 60}
+	if p.Days == "" {
+		for i := range r.days {
+			r.days[i] = true
+		}
+	}
+	for _, s := range strings.Split(p.Days, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		from, to := s, s
+		if i := strings.IndexByte(s, '-'); i != -1 {
+			from, to = s[:i], s[i+1:]
+		}
+		a, b := parseweekday(from), parseweekday(to)
+		if a == -1 || b == -1 {
+			return nil, fmt.Errorf("invalid days: %s", p.Days)
+		}
+		for d := a; ; d = (d + 1) % 7 {
+			r.days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	if p.Hours != "" {
+		i := strings.IndexByte(p.Hours, '-')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid hours: %s", p.Hours)
+		}
+		var err1, err2 error
+		r.start, err1 = parseclock(p.Hours[:i])
+		r.end, err2 = parseclock(p.Hours[i+1:])
+		if err1 != nil || err2 != nil || r.start == r.end {
+			return nil, fmt.Errorf("invalid hours: %s", p.Hours)
+		}
+	}
+	return r, nil
+}
+
+func parseweekday(s string) int {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, d := range weekdays {
+		if len(s) >= 3 && strings.HasPrefix(d, s[:3]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseclock parses "15:04" into minutes from midnight, "24:00" is allowed.
+func parseclock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m); err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports if t is in the period. Times after midnight
+// of a wrapping period belong to the day the period started.
+func (r *period) contains(t time.Time) bool {
+	m, day := t.Hour()*60+t.Minute(), int(t.Weekday())
+	if r.start < r.end {
+		return r.days[day] && r.start <= m && m < r.end
+	}
+	return (r.days[day] && m >= r.start) || (r.days[(day+6)%7] && m < r.end)
+}
+
+// endafter returns the end of the period containing t.
+func (r *period) endafter(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	end := time.Date(y, mo, d, 0, r.end, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// schedule is the bandwidth limit and the pauses of a destination.
+type schedule struct {
+	limit int64 // default limit in bytes/s, 0 if unlimited
+	rules []*period
+	rlim  []int64
+	pause []*period
+}
+
+func newschedule(c DestConfig) (*schedule, error) {
+	s := new(schedule)
+	var err error
+	if s.limit, err = parselimit(c.Bandwidth); err != nil {
+		return nil, fmt.Errorf("invalid bandwidth: %v", err)
+	}
+	for _, r := range c.Schedule {
+		p, err := parseperiod(r.Period)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parselimit(r.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth: %v", err)
+		}
+		s.rules, s.rlim = append(s.rules, p), append(s.rlim, l)
+	}
+	for _, r := range c.Pause {
+		p, err := parseperiod(r)
+		if err != nil {
+			return nil, err
+		}
+		s.pause = append(s.pause, p)
+	}
+	return s, nil
+}
+
+func parselimit(s string) (int64, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	return parsebytesize(s)
+}
+
+// limitat returns the bandwidth limit at t, 0 if unlimited.
+// The first matching rule of the schedule is used.
+func (s *schedule) limitat(t time.Time) int64 {
+	for i, r := range s.rules {
+		if r.contains(t) {
+			return s.rlim[i]
+		}
+	}
+	return s.limit
+}
+
+// pausedat returns the end of the pause containing t,
+// or the zero time if delivery is not paused at t.
+func (s *schedule) pausedat(t time.Time) time.Time {
+	var end time.Time
+	// follow overlapping or adjacent pauses, up to a week
+	for i := 0; i < 7*len(s.pause)+1; i++ {
+		found := false
+		for _, r := range s.pause {
+			if r.contains(t) {
+				t, found = r.endafter(t), true
+				end = t
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return end
+}
+
+// ratelimiter is a token bucket shared by the workers of an uploader.
+type ratelimiter struct {
+	mtx    sync.Mutex
+	sched  *schedule
+	tokens float64
+	last   time.Time
+}
+
+// take reserves at most n bytes to be sent, and returns the number
+// of bytes reserved and the time to wait before sending them.
+func (l *ratelimiter) take(n int) (int, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	rate := float64(l.sched.limitat(now))
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		return n, 0
+	}
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	l.last = now
+	if l.tokens > rate {
+		// allow bursts of one second
+		l.tokens = rate
+	}
+	chunk := int(rate / 10)
+	if chunk < 512 {
+		chunk = 512
+	}
+	if n > chunk {
+		n = chunk
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return n, 0
+	}
+	return n, time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// reader returns r limited to the current bandwidth.
+func (l *ratelimiter) reader(r io.Reader) io.Reader {
+	return &limitedreader{r, l}
+}
+
+type limitedreader struct {
+	r io.Reader
+	l *ratelimiter
+}
+
+func (r *limitedreader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+	n, wait := r.l.take(len(p))
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return r.r.Read(p[:n])
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// thursday 2014-06-12 at hh:mm, offset by days
+func testtime(days, hh, mm int) time.Time {
+	return time.Date(2014, 6, 12+days, hh, mm, 0, 0, time.UTC)
+}
+
+func TestParsePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		p          Period
+		days       string // S M T W T F S
+		start, end int
+	}{
+		{Period{}, "xxxxxxx", 0, 24 * 60},
+		{Period{"Mon-Fri", "08:00-18:00"}, ".xxxxx.", 8 * 60, 18 * 60},
+		{Period{"sat, Sunday", ""}, "x.....x", 0, 24 * 60},
+		{Period{"Fri-Mon", "22:30-06:00"}, "xx...xx", 22*60 + 30, 6 * 60},
+		{Period{"wed", "0:00-24:00"}, "...x...", 0, 24 * 60},
+	} {
+		r, err := parseperiod(tc.p)
+		if err != nil {
+			t.Errorf("%v: %v", tc.p, err)
+			continue
+		}
+		days := ""
+		for _, d := range r.days {
+			if d {
+				days += "x"
+			} else {
+				days += "."
+			}
+		}
+		if days != tc.days || r.start != tc.start || r.end != tc.end {
+			t.Errorf("%v: got %s %d-%d, want %s %d-%d", tc.p, days, r.start, r.end, tc.days, tc.start, tc.end)
+		}
+	}
+	for _, p := range []Period{
+		{"Mon-Foo", ""},
+		{"Mo", ""},
+		{"", "08:00"},
+		{"", "08:00-08:00"},
+		{"", "08:60-09:00"},
+		{"", "23:00-24:01"},
+		{"", "8-18"},
+	} {
+		if _, err := parseperiod(p); err == nil {
+			t.Errorf("%v: no error", p)
+		}
+	}
+}
+
+func TestPausedAt(t *testing.T) {
+	s, err := newschedule(DestConfig{Pause: []Period{
+		{"Mon-Fri", "08:00-12:00"},
+		{"Mon-Fri", "12:00-13:00"},
+		{"Fri", "22:00-02:00"},
+		{"Sat,Sun", ""},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		t, end time.Time
+	}{
+		{testtime(0, 7, 59), time.Time{}},
+		{testtime(0, 8, 0), testtime(0, 13, 0)},
+		{testtime(0, 12, 30), testtime(0, 13, 0)},
+		{testtime(0, 13, 0), time.Time{}},
+		{testtime(1, 21, 59), time.Time{}},
+		// friday night runs into the weekend
+		{testtime(1, 23, 0), testtime(4, 0, 0)},
+		{testtime(2, 1, 0), testtime(4, 0, 0)},
+		{testtime(3, 23, 59), testtime(4, 0, 0)},
+		// monday is paused from 8:00 only
+		{testtime(4, 0, 0), time.Time{}},
+		{testtime(4, 8, 0), testtime(4, 13, 0)},
+	} {
+		if end := s.pausedat(tc.t); !end.Equal(tc.end) {
+			t.Errorf("%s: paused until %s, want %s", tc.t.Format("Mon 15:04"), end, tc.end)
+		}
+	}
+}
+
+func TestLimitAt(t *testing.T) {
+	s, err := newschedule(DestConfig{Bandwidth: "4M", Schedule: []BandwidthRule{
+		{Period{"Mon-Fri", "08:00-18:00"}, "2M"},
+		{Period{"", "22:00-06:00"}, "0"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		t     time.Time
+		limit int64
+	}{
+		{testtime(0, 7, 0), 4000000},
+		{testtime(0, 8, 0), 2000000},
+		{testtime(0, 17, 59), 2000000},
+		{testtime(0, 23, 0), 0},
+		{testtime(1, 5, 59), 0},
+		{testtime(2, 12, 0), 4000000},
+	} {
+		if l := s.limitat(tc.t); l != tc.limit {
+			t.Errorf("%s: limit %d, want %d", tc.t.Format("Mon 15:04"), l, tc.limit)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -9,32 +13,81 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
+// prefixes of the keys in the index
+const (
+	ENTRY_KEY = "entry/"
+	DAILY_KEY = "daily/"
+)
+
+// interval of checking if all files are delivered before exit
+const CACHE_DRAIN_POLL = 100 * time.Millisecond
+
 // CacheDir is a directory holding temporary/cached files.
 type CacheDir struct {
 	Path    string `json:"-"`
 	MaxSize int64  `json:"-"`
 	size    int64  `json:"-"`
 	Entries []*CacheEntry
+	Daily   map[string]DailyUsage // bytes uploaded today by user
 	scratch []*CacheEntry
 	log     *log.Logger
 	mtx     sync.RWMutex
+	block   cipher.Block // cache encryption, nil if disabled
+	limits  UserLimits
+	users   map[string]*userusage
+	db      *journal       // index of entries and daily usage
+	pending journalbatch   // updates of db not yet written
+	dbmtx   sync.Mutex     // keeps the order of the writes to db
+	volumes []*cachevolume // the first one is Path
+	minfree int64          // free space to keep on volumes
+}
+
+// CacheOptions are the settings of a cache directory.
+type CacheOptions struct {
+	Path    string         // directory of the cache, from GetCacheDir if empty
+	MaxSize int64          // total size of cached files
+	MinFree int64          // free space to keep on the disks of volumes
+	Volumes []*cachevolume // additional directories for cached files
+	Encrypt bool           // encrypt content with a key kept only in memory
+	Limits  UserLimits     // limits of each user
 }
 
 // OpenCacheDir opens or creates a cache directory, and
 // loads already cached content, if available.
-func OpenCacheDir(name string, maxsiz int64) (*CacheDir, error) {
-	p, err := GetCacheDir(name)
+func OpenCacheDir(name string, opt CacheOptions) (*CacheDir, error) {
+	p := opt.Path
+	if p == "" {
+		var err error
+		if p, err = GetCacheDir(name); err != nil {
+			return nil, err
+		}
+	}
+	home, err := newcachevolume(p, 0)
 	if err != nil {
 		return nil, err
 	}
 	d := &CacheDir{
-		Path:    p,
-		MaxSize: maxsiz,
+		Path:    home.path,
+		MaxSize: opt.MaxSize,
+		limits:  opt.Limits,
+		users:   make(map[string]*userusage),
+		Daily:   make(map[string]DailyUsage),
+		volumes: append([]*cachevolume{home}, opt.Volumes...),
+		minfree: opt.MinFree,
 		log:     log.New(os.Stderr, "CACHE   ", log.LstdFlags),
 	}
 	d.log.Println("initializing in", d.Path, "with limit", d.MaxSize)
+	for _, v := range opt.Volumes {
+		d.log.Println("using volume", v.path, "with limit", v.maxsize)
+	}
+	if opt.Encrypt {
+		if d.block, err = newcachekey(); err != nil {
+			return nil, err
+		}
+	}
 	if err = d.load(); err != nil {
 		return nil, err
 	}
@@ -42,19 +95,41 @@ func OpenCacheDir(name string, maxsiz int64) (*CacheDir, error) {
 }
 
 // Add a new cache entry for the user and filename using the provided io.Reader.
-func (d *CacheDir) Add(user, filename string, r io.Reader) (f CachedFile, err error) {
-	cachedname, siz, err := d.cachecontent(r)
+// Lang is the language of the page used for the upload, addr is the
+// IP address of the uploader. A *QuotaError is returned if
+// a limit of the user has been reached.
+func (d *CacheDir) Add(user, filename, lang, addr string, r io.Reader) (f CachedFile, err error) {
+	if err = d.reservefile(user); err != nil {
+		return nil, err
+	}
+	ul := &userlimiter{d: d, user: user}
+	cachedname, siz, sum, err := d.cachecontent(ul, r)
 	if err != nil {
+		d.releasefile(user)
 		return nil, err
 	}
 
 	d.mtx.Lock()
-	// d.size is already increased in cachecontent/LimitWriter
-	e := &CacheEntry{d, user, filename, cachedname, siz}
+	// d.size and the size of the user are already
+	// increased in cachecontent/LimitWriter
+	ul.done()
+	d.prunedaily()
+	d.adddaily(user, siz)
+	e := &CacheEntry{d, user, filename, cachedname, "", siz, sum, lang, addr, time.Now(), d.block != nil, nil, nil}
+	if same := d.samecontent(e); same != nil {
+		// share the content already cached
+		if os.Remove(cachedname) == nil {
+			d.addsize(cachedname, -siz)
+		}
+		e.Cn, e.Id = same.Cn, filepath.Base(cachedname)
+		d.log.Println("Added", e.Fn, "for", e.Un, "as", e.Id, "sharing content of", same.Fn, "for", same.Un)
+	} else {
+		d.log.Println("Added", e.Fn, "for", e.Un, "as", filepath.Base(e.Cn))
+	}
 	d.Entries = append(d.Entries, e)
-	d.log.Println("Added", e.Fn, "for", e.Un, "as", filepath.Base(e.Cn))
-	d.save()
+	d.saveentry(e)
 	d.mtx.Unlock()
+	d.flush()
 
 	notifier.notify(user)
 	return e, nil
@@ -63,9 +138,12 @@ func (d *CacheDir) Add(user, filename string, r io.Reader) (f CachedFile, err er
 // Files returns a channel that lists cached files. Useful for
 // handling cached, but not yet processed files after a crash or reload.
 func (d *CacheDir) Files() <-chan CachedFile {
+	d.mtx.RLock()
+	entries := append([]*CacheEntry(nil), d.Entries...)
+	d.mtx.RUnlock()
 	ch := make(chan CachedFile)
 	go func() {
-		for _, e := range d.Entries {
+		for _, e := range entries {
 			ch <- e
 		}
 		close(ch)
@@ -73,14 +151,19 @@ func (d *CacheDir) Files() <-chan CachedFile {
 	return ch
 }
 
-// Userfiles returns a new lists of cached files for the user.
-func (d *CacheDir) Userfiles(user string) (r []string) {
+// Userfiles returns new lists of cached files for the user. Files already
+// delivered to some, but not all destinations are returned in partial.
+func (d *CacheDir) Userfiles(user string) (cached, partial []string) {
 	user = strings.ToLower(user)
 	d.mtx.RLock()
 	defer d.mtx.RUnlock()
 	for _, e := range d.Entries {
 		if strings.ToLower(e.Un) == user {
-			r = append(r, e.Fn)
+			if len(e.Dn) == 0 {
+				cached = append(cached, e.Fn)
+			} else {
+				partial = append(partial, e.Fn)
+			}
 		}
 	}
 	return
@@ -92,42 +175,105 @@ func (d *CacheDir) Size() int64 {
 	return d.size
 }
 
-func (d *CacheDir) cachecontent(r io.Reader) (cachedname string, siz int64, err error) {
+// cachecontent stores content from r in a new file, allocating
+// space with ul, and calculates its SHA-256 sum on the way.
+func (d *CacheDir) cachecontent(ul *userlimiter, r io.Reader) (cachedname string, siz int64, sum string, err error) {
 	var f *os.File
-	if f, err = ioutil.TempFile(d.Path, "cache-"); err != nil {
+	ul.v = d.choosevolume()
+	if f, err = ioutil.TempFile(ul.v.path, "cache-"); err != nil {
 		return
 	}
 	cachedname = f.Name()
-	w := NewLimitWriter(f, d)
+	var w io.Writer
+	lw := NewLimitWriter(f, ul)
+	w = lw
 	defer func() {
 		f.Close()
-		w.Finish()
+		lw.Finish()
+		if err != nil && ul.err != nil {
+			d.log.Println("User", ul.user, "limit:", ul.err)
+			err = ul.err
+		}
 		if err != nil {
 			if os.Remove(cachedname) == nil {
-				w.Free()
+				lw.Free()
+			} else {
+				d.mtx.Lock()
+				ul.done()
+				d.mtx.Unlock()
 			}
 		}
 	}()
-	siz, err = io.Copy(w, r)
+	if d.block != nil {
+		if w, err = encryptwriter(f, lw, d.block); err != nil {
+			return
+		}
+	}
+	h := sha256.New()
+	if siz, err = io.Copy(w, io.TeeReader(r, h)); err == nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
 	return
 }
 
-func (d *CacheDir) open(e *CacheEntry) (io.ReadCloser, error) {
-	return os.Open(e.Cn)
+func (d *CacheDir) open(e *CacheEntry) (io.ReadSeekCloser, error) {
+	f, err := os.Open(e.Cn)
+	if err != nil || !e.Enc {
+		return f, err
+	}
+	r, err := decryptreader(f, d.block)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
 }
 
-func (d *CacheDir) remove(old *CacheEntry) (err error) {
-	err = os.Remove(old.Cn)
+// samecontent returns an entry with the same content as n, or nil.
+// Must be called with d.mtx held.
+func (d *CacheDir) samecontent(n *CacheEntry) *CacheEntry {
+	for _, e := range d.Entries {
+		if e.Sha == n.Sha && e.Siz == n.Siz && e.Enc == n.Enc && e.Sha != "" {
+			return e
+		}
+	}
+	return nil
+}
 
+// refs returns the number of entries using the content file cn.
+// Must be called with d.mtx held.
+func (d *CacheDir) refs(cn string) int {
+	n := 0
+	for _, e := range d.Entries {
+		if e.Cn == cn {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *CacheDir) remove(old *CacheEntry) (err error) {
 	d.mtx.Lock()
-	d.size -= old.Siz
 	d.filterentries(func(e *CacheEntry) bool {
 		return e != old
 	})
-	d.save()
+	shared := d.refs(old.Cn) != 0
+	if !shared {
+		d.addsize(old.Cn, -old.Siz)
+	}
+	u := d.usage(old.Un)
+	u.size -= old.Siz
+	u.files--
+	d.deleteentry(old)
 	d.mtx.Unlock()
+	d.flush()
+
+	// content shared with other entries is removed with the last one
+	if !shared {
+		err = os.Remove(old.Cn)
+	}
 
-	d.log.Println("Removed", old.Fn, "for", old.Un, "as", filepath.Base(old.Cn))
+	d.log.Println("Removed", old.Fn, "for", old.Un, "as", old.ID())
 	if err != nil {
 		d.log.Println("Remove failed:", err)
 	}
@@ -136,100 +282,291 @@ func (d *CacheDir) remove(old *CacheEntry) (err error) {
 	return
 }
 
-func (d *CacheDir) clearoldfiles() error {
-	dir, err := os.Open(d.Path)
+func (d *CacheDir) delivered(e *CacheEntry, dest string) bool {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	for _, n := range e.Dn {
+		if n == dest {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *CacheDir) setdelivered(e *CacheEntry, dest string) {
+	if d.delivered(e, dest) {
+		return
+	}
+	d.mtx.Lock()
+	e.Dn = append(e.Dn, dest)
+	d.log.Println("Delivered", e.Fn, "for", e.Un, "to", dest)
+	d.saveentry(e)
+	d.mtx.Unlock()
+	d.flush()
+
+	notifier.notify(e.Un)
+}
+
+func (d *CacheDir) dead(e *CacheEntry, dest string) string {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return e.Dl[dest]
+}
+
+func (d *CacheDir) setdead(e *CacheEntry, dest, reason string) {
+	d.mtx.Lock()
+	if reason != "" {
+		if e.Dl == nil {
+			e.Dl = make(map[string]string)
+		}
+		e.Dl[dest] = reason
+	} else {
+		delete(e.Dl, dest)
+	}
+	d.saveentry(e)
+	d.mtx.Unlock()
+	d.flush()
+}
+
+func (d *CacheDir) clearoldfiles() (err error) {
+	for _, v := range d.volumes {
+		if errv := d.clearoldfilesin(v.path); err == nil {
+			err = errv
+		}
+	}
+	return
+}
+
+func (d *CacheDir) clearoldfilesin(path string) error {
+	dir, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer dir.Close()
 	nold, nclear := 0, 0
 	names, err := dir.Readdirnames(0)
 	if err != nil {
 		return err
 	}
 	for _, fn := range names {
+		if strings.HasPrefix(fn, "enc-") {
+			// encrypted copy of a file being uploaded
+			if os.Remove(filepath.Join(path, fn)) == nil {
+				nclear++
+			}
+			nold++
+			continue
+		}
 		if len(fn) < 6 || fn[:6] != "cache-" {
 			continue
 		}
 		old := true
 		for _, e := range d.Entries {
-			if fn == filepath.Base(e.Cn) {
+			if filepath.Join(path, fn) == filepath.Clean(e.Cn) {
 				old = false
 				break
 			}
 		}
 		if old {
 			nold++
-			errx := os.Remove(filepath.Join(d.Path, fn))
-			if err == nil {
-				err = errx
-			} else {
+			errx := os.Remove(filepath.Join(path, fn))
+			if errx == nil {
 				nclear++
+			} else if err == nil {
+				err = errx
 			}
 		}
 	}
 	if nold != 0 {
 		if nclear == nold {
-			d.log.Println(nold, "incomplete/invalid files were cleared")
+			d.log.Println(nold, "incomplete/invalid files were cleared in", path)
 		} else {
-			d.log.Println(nold, "incomplete/invalid files found, of which", nclear, "could be cleared")
+			d.log.Println(nold, "incomplete/invalid files found in", path, "of which", nclear, "could be cleared")
 		}
 	}
 	return err
 }
 
-func (d *CacheDir) load() error {
-	f, err := os.Open(d.datafilename())
-	switch {
-	case err == nil:
-		defer f.Close()
-		err = json.NewDecoder(f).Decode(&d)
-	case os.IsNotExist(err):
-		err = nil
+func (d *CacheDir) load() (err error) {
+	if d.db, err = openjournal(d.datafilename(), d.log); err != nil {
+		d.log.Println("Load error:", err)
+		return err
 	}
-	if err != nil {
+	if err = d.importjson(); err != nil {
 		d.log.Println("Load error:", err)
 		return err
 	}
+	d.db.each(func(key string, val json.RawMessage) {
+		var err error
+		switch {
+		case strings.HasPrefix(key, ENTRY_KEY):
+			e := new(CacheEntry)
+			if err = json.Unmarshal(val, e); err == nil {
+				d.Entries = append(d.Entries, e)
+			}
+		case strings.HasPrefix(key, DAILY_KEY):
+			var u DailyUsage
+			if err = json.Unmarshal(val, &u); err == nil {
+				d.Daily[key[len(DAILY_KEY):]] = u
+			}
+		}
+		if err != nil {
+			d.log.Println("Invalid record", key+":", err)
+		}
+	})
+	nenc := 0
 	d.filterentries(func(e *CacheEntry) bool {
+		if e.Enc {
+			// the key of encrypted files is lost on restart
+			d.log.Println("Discarding", e.Fn, "for", e.Un+", encrypted with the key of the previous run")
+			nenc++
+			d.deleteentry(e)
+			return false
+		}
 		// keep only existing files
-		_, xerr := os.Stat(e.Cn)
-		return xerr == nil
+		if _, xerr := os.Stat(e.Cn); xerr != nil {
+			d.deleteentry(e)
+			return false
+		}
+		return true
 	})
+	if nenc != 0 {
+		d.log.Println(nenc, "encrypted files from the previous run can't be read, discarded")
+	}
+	d.prunedaily()
 	d.size = 0
+	seen := make(map[string]bool)
 	for _, e := range d.Entries {
 		e.dir = d
-		d.size += e.Siz
+		u := d.usage(e.Un)
+		u.size += e.Siz
+		u.files++
+		// shared content is counted once
+		if !seen[e.Cn] {
+			seen[e.Cn] = true
+			d.addsize(e.Cn, e.Siz)
+		}
 	}
+	d.flush()
 	d.log.Println("Loaded cache of", d.size, "bytes in", len(d.Entries), "files")
 	if errc := d.clearoldfiles(); errc != nil {
 		d.log.Println("error clearing old files:", errc)
 	}
-	return err
+	return nil
 }
 
-func (d *CacheDir) save() {
-	if len(d.Entries) == 0 {
-		err := os.Remove(d.datafilename())
-		if err != nil {
-			d.log.Println("Can't cleanup:", err)
-		}
-		return
+// importjson moves the entries from the cachefiles.json
+// of earlier versions into the journal.
+func (d *CacheDir) importjson() error {
+	fn := d.Path + "/cachefiles.json"
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	f, err := SafeFileWriter(d.datafilename())
-	if err == nil {
-		defer func() {
-			err = f.Close()
-			if err != nil {
-				d.log.Println("Can't close:", err)
-			}
-		}()
-		err = json.NewEncoder(f).Encode(d)
+	if err != nil {
+		return err
+	}
+	var old struct {
+		Entries []*CacheEntry
+		Daily   map[string]DailyUsage
 	}
+	err = json.NewDecoder(f).Decode(&old)
+	f.Close()
 	if err != nil {
+		return err
+	}
+	// keys are the same if interrupted and run again
+	for _, e := range old.Entries {
+		if err = d.db.put(ENTRY_KEY+e.ID(), e); err != nil {
+			return err
+		}
+	}
+	for user, u := range old.Daily {
+		if err = d.db.put(DAILY_KEY+user, u); err != nil {
+			return err
+		}
+	}
+	d.log.Println("Imported", len(old.Entries), "files from", fn)
+	return os.Remove(fn)
+}
+
+// saveentry stores e in the index, once flushed.
+// Must be called with d.mtx held.
+func (d *CacheDir) saveentry(e *CacheEntry) {
+	if err := d.pending.put(ENTRY_KEY+e.ID(), e); err != nil {
+		d.log.Println("Can't save:", err)
+	}
+}
+
+// deleteentry removes e from the index, once flushed.
+// Must be called with d.mtx held.
+func (d *CacheDir) deleteentry(e *CacheEntry) {
+	d.pending.delete(ENTRY_KEY + e.ID())
+}
+
+// flush writes the pending updates to the index. It is called
+// without d.mtx held, so that other files can be added or
+// uploaded while they are synced to disk.
+func (d *CacheDir) flush() {
+	d.dbmtx.Lock()
+	defer d.dbmtx.Unlock()
+	d.mtx.Lock()
+	b := d.pending
+	d.pending = nil
+	d.mtx.Unlock()
+	if err := d.db.commit(b); err != nil {
 		d.log.Println("Can't save:", err)
 	}
 }
 
+// Encrypted reports if the content is encrypted with a key
+// lost on exit.
+func (d *CacheDir) Encrypted() bool {
+	return d.block != nil
+}
+
+// undelivered returns the number of files not yet delivered
+// to all destinations, except dead letters.
+func (d *CacheDir) undelivered() (n int) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	for _, e := range d.Entries {
+		if len(e.Dl) == 0 {
+			n++
+		}
+	}
+	return
+}
+
+// Drain waits until the files are delivered, except
+// dead letters, or ctx is done.
+func (d *CacheDir) Drain(ctx context.Context) error {
+	for d.undelivered() != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(CACHE_DRAIN_POLL):
+		}
+	}
+	return nil
+}
+
+// Close closes the index of the cache. Encrypted files still
+// cached are lost with the key, and are logged.
+func (d *CacheDir) Close() error {
+	if d.Encrypted() {
+		d.mtx.RLock()
+		for _, e := range d.Entries {
+			d.log.Println("Encrypted file", e.Fn, "for", e.Un, "not delivered, it is lost")
+		}
+		d.mtx.RUnlock()
+	}
+	d.flush()
+	d.dbmtx.Lock()
+	defer d.dbmtx.Unlock()
+	return d.db.close()
+}
+
 func (d *CacheDir) filterentries(f func(e *CacheEntry) bool) {
 	d.scratch = d.scratch[:0]
 	for _, e := range d.Entries {
@@ -241,32 +578,60 @@ func (d *CacheDir) filterentries(f func(e *CacheEntry) bool) {
 }
 
 func (d *CacheDir) datafilename() string {
-	return d.Path + "/cachefiles.json"
+	return d.Path + "/cachefiles.journal"
 }
 
-func (d *CacheDir) AllocBytes(n int) bool {
-	d.mtx.Lock()
-	defer d.mtx.Unlock()
-	if d.size+int64(n) <= d.MaxSize {
-		d.size += int64(n)
-		return true
+// allocbytes allocates n bytes on v. Must be called with d.mtx held.
+func (d *CacheDir) allocbytes(v *cachevolume, n int) bool {
+	if d.size+int64(n) > d.MaxSize {
+		d.log.Println("buffer full: couldn't allocate", n, "bytes")
+		return false
 	}
-	d.log.Println("buffer full: couldn't allocate", n, "bytes")
-	return false
-}
-
-func (d *CacheDir) FreeBytes(n int) {
-	d.mtx.Lock()
-	defer d.mtx.Unlock()
-	d.size -= int64(n)
+	if d.room(v) < int64(n) {
+		d.log.Println("volume", v.path, "full: couldn't allocate", n, "bytes")
+		return false
+	}
+	d.size += int64(n)
+	v.size += int64(n)
+	return true
 }
 
 type CachedFile interface {
 	User() string
 	Filename() string
-	Open() (io.ReadCloser, error)
+	Open() (io.ReadSeekCloser, error)
 	Discard() error
 	Size() int64
+
+	// Sum returns the hex encoded SHA-256 sum of the content,
+	// or an empty string if it is not known.
+	Sum() string
+
+	// Lang returns the language of the page used for the upload.
+	Lang() string
+
+	// Time returns the time of the upload, zero if unknown.
+	Time() time.Time
+
+	// RemoteAddr returns the IP address of the uploader, if known.
+	RemoteAddr() string
+
+	// Delivered reports if the file has been delivered to dest.
+	Delivered(dest string) bool
+
+	// SetDelivered records that the file has been delivered to dest.
+	SetDelivered(dest string)
+
+	// ID returns a string identifying the file in the cache.
+	ID() string
+
+	// Dead returns the reason why the file can't be delivered to
+	// dest, or an empty string if the file is not a dead letter.
+	Dead(dest string) string
+
+	// SetDead marks the file as a dead letter for dest,
+	// an empty reason clears the mark.
+	SetDead(dest, reason string)
 }
 
 type CacheEntry struct {
@@ -274,11 +639,34 @@ type CacheEntry struct {
 	Un  string
 	Fn  string
 	Cn  string
+	Id  string // unique ID if content is shared, base of Cn otherwise
 	Siz int64
+	Sha string            // hex SHA-256 of content
+	Ln  string            // language of upload page
+	Ip  string            // address of uploader
+	Tm  time.Time         // time of upload
+	Enc bool              // content is encrypted with the cache key
+	Dn  []string          // destinations already delivered to
+	Dl  map[string]string // dead letter reason for destinations
 }
 
-func (e *CacheEntry) User() string                 { return e.Un }
-func (e *CacheEntry) Filename() string             { return e.Fn }
-func (e *CacheEntry) Open() (io.ReadCloser, error) { return e.dir.open(e) }
-func (e *CacheEntry) Discard() error               { return e.dir.remove(e) }
-func (e *CacheEntry) Size() int64                  { return e.Siz }
+func (e *CacheEntry) User() string                     { return e.Un }
+func (e *CacheEntry) Filename() string                 { return e.Fn }
+func (e *CacheEntry) Open() (io.ReadSeekCloser, error) { return e.dir.open(e) }
+func (e *CacheEntry) Discard() error                   { return e.dir.remove(e) }
+func (e *CacheEntry) Size() int64                      { return e.Siz }
+func (e *CacheEntry) Sum() string                      { return e.Sha }
+func (e *CacheEntry) Lang() string                     { return e.Ln }
+func (e *CacheEntry) Time() time.Time                  { return e.Tm }
+func (e *CacheEntry) RemoteAddr() string               { return e.Ip }
+func (e *CacheEntry) Delivered(dest string) bool       { return e.dir.delivered(e, dest) }
+func (e *CacheEntry) SetDelivered(dest string)         { e.dir.setdelivered(e, dest) }
+func (e *CacheEntry) Dead(dest string) string          { return e.dir.dead(e, dest) }
+func (e *CacheEntry) SetDead(dest, reason string)      { e.dir.setdead(e, dest, reason) }
+
+func (e *CacheEntry) ID() string {
+	if e.Id != "" {
+		return e.Id
+	}
+	return filepath.Base(e.Cn)
+}
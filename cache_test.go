@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func opentestcache(t *testing.T, p string) *CacheDir {
+	d, err := OpenCacheDir("", CacheOptions{Path: p, MaxSize: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func entrynames(d *CacheDir) string {
+	var v []string
+	for _, e := range d.Entries {
+		v = append(v, e.Un+"/"+e.Fn)
+	}
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
+
+func TestCacheImportJSON(t *testing.T) {
+	p := t.TempDir()
+	cn := filepath.Join(p, "cache-1")
+	if err := ioutil.WriteFile(cn, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var old struct {
+		Entries []*CacheEntry
+		Daily   map[string]DailyUsage
+	}
+	old.Entries = []*CacheEntry{
+		{Un: "john", Fn: "a.txt", Cn: cn, Siz: 5, Tm: time.Now()},
+		{Un: "john", Fn: "gone.txt", Cn: filepath.Join(p, "cache-2"), Siz: 3, Tm: time.Now()},
+	}
+	old.Daily = map[string]DailyUsage{"john": {today(), 8}, "anna": {"2014-06-12", 1}}
+	b, err := json.Marshal(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(p, "cachefiles.json"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		d := opentestcache(t, p)
+		if names := entrynames(d); names != "john/a.txt" {
+			t.Errorf("open %d: entries %s, want john/a.txt", i, names)
+		}
+		if d.Size() != 5 || d.daily("john") != 8 || len(d.Daily) != 1 {
+			t.Errorf("open %d: size %d, daily %v", i, d.Size(), d.Daily)
+		}
+		d.Close()
+		if _, err = os.Stat(filepath.Join(p, "cachefiles.json")); !os.IsNotExist(err) {
+			t.Error("cachefiles.json not removed:", err)
+		}
+	}
+}
+
+func TestCacheRecovery(t *testing.T) {
+	p := t.TempDir()
+	d := opentestcache(t, p)
+	var gone CachedFile
+	for _, fn := range []string{"a.txt", "b.txt"} {
+		f, err := d.Add("John", fn, "en", "127.0.0.1", strings.NewReader(fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gone = f
+	}
+	d.Close()
+	// content lost in a crash, files left over
+	if err := os.Remove(gone.(*CacheEntry).Cn); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"cache-orphan", "enc-1"} {
+		if err := ioutil.WriteFile(filepath.Join(p, fn), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d = opentestcache(t, p)
+	defer d.Close()
+	if names := entrynames(d); names != "John/a.txt" {
+		t.Errorf("entries %s, want John/a.txt", names)
+	}
+	if d.Size() != 5 || d.db.len() != 2 {
+		t.Errorf("size %d, %d records, want 5, 2", d.Size(), d.db.len())
+	}
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, fi := range fis {
+		left = append(left, fi.Name())
+	}
+	want := filepath.Base(d.Entries[0].Cn) + " cachefiles.journal"
+	if strings.Join(left, " ") != want {
+		t.Errorf("files %v, want %s", left, want)
+	}
+}
+
+func TestUserLimits(t *testing.T) {
+	for _, tc := range []struct {
+		limits UserLimits
+		before []int // sizes of earlier uploads
+		size   int
+		limit  string // limit hit, if any
+	}{
+		{UserLimits{Daily: 500000}, nil, 5, ""},
+		{UserLimits{Daily: 500000}, []int{400000}, 100000, ""},
+		{UserLimits{Daily: 500000}, []int{400000}, 100001, QUOTA_DAILY},
+		{UserLimits{Daily: 3000000}, []int{1500000}, 1500000, ""},
+		{UserLimits{CacheSize: 2000000}, nil, 1500000, ""},
+		{UserLimits{CacheSize: 2000000}, []int{1500000}, 500000, ""},
+		{UserLimits{CacheSize: 2000000}, []int{1500000}, 500001, QUOTA_CACHE},
+		{UserLimits{Files: 2}, []int{1}, 1, ""},
+		{UserLimits{Files: 2}, []int{1, 1}, 1, QUOTA_FILES},
+	} {
+		d, err := OpenCacheDir("", CacheOptions{Path: t.TempDir(), MaxSize: 1 << 30, Limits: tc.limits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range append(tc.before, tc.size) {
+			_, err = d.Add("john", "f", "en", "", strings.NewReader(strings.Repeat(string(rune('a'+i)), n)))
+			if i < len(tc.before) && err != nil {
+				t.Fatalf("%+v: earlier upload: %v", tc.limits, err)
+			}
+		}
+		qe, _ := err.(*QuotaError)
+		switch {
+		case tc.limit == "" && err != nil:
+			t.Errorf("%+v: %v", tc.limits, err)
+		case tc.limit != "" && (qe == nil || qe.Limit != tc.limit):
+			t.Errorf("%+v: got %v, want %s limit", tc.limits, err, tc.limit)
+		}
+		if u := d.usage("john"); u.writing != 0 {
+			t.Errorf("%+v: %d bytes still being written", tc.limits, u.writing)
+		}
+		d.Close()
+	}
+}
+
+func TestDailyLimitConcurrent(t *testing.T) {
+	d, err := OpenCacheDir("", CacheOptions{Path: t.TempDir(), MaxSize: 1 << 30, Limits: UserLimits{Daily: 500000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// two uploads being written at the same time
+	l1 := &userlimiter{d: d, v: d.volumes[0], user: "john"}
+	l2 := &userlimiter{d: d, v: d.volumes[0], user: "John"}
+	if !l1.AllocBytes(300000) {
+		t.Fatal("first upload refused:", l1.err)
+	}
+	if l2.AllocBytes(300000) {
+		t.Error("second upload accepted beyond the daily limit")
+	}
+	if qe, ok := l2.err.(*QuotaError); !ok || qe.Limit != QUOTA_DAILY {
+		t.Errorf("got %v, want daily limit", l2.err)
+	}
+	l1.FreeBytes(300000)
+	if !l2.AllocBytes(300000) {
+		t.Error("refused after the first upload was freed:", l2.err)
+	}
+}
+
+func TestDailyReset(t *testing.T) {
+	d, err := OpenCacheDir("", CacheOptions{Path: t.TempDir(), MaxSize: 1 << 30, Limits: UserLimits{Daily: 500000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// uploaded until yesterday's midnight
+	d.Daily["john"] = DailyUsage{time.Now().AddDate(0, 0, -1).Format("2006-01-02"), 499999}
+	if n := d.daily("john"); n != 0 {
+		t.Errorf("%d bytes uploaded today, want 0", n)
+	}
+	if _, err = d.Add("John", "f", "en", "", strings.NewReader(strings.Repeat("x", 100000))); err != nil {
+		t.Fatal(err)
+	}
+	if u := d.Daily["john"]; u.Day != today() || u.Bytes != 100000 {
+		t.Errorf("daily usage %+v, want %s 100000", u, today())
+	}
+}
+
+func TestQuotaStatus(t *testing.T) {
+	for _, tc := range []struct {
+		limit  string
+		status int
+	}{
+		{QUOTA_CACHE, http.StatusRequestEntityTooLarge},
+		{QUOTA_FILES, http.StatusTooManyRequests},
+		{QUOTA_DAILY, http.StatusTooManyRequests},
+	} {
+		e := &QuotaError{tc.limit, 1}
+		if status := quotastatus(e); status != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.limit, status, tc.status)
+		}
+		if !strings.Contains(e.Error(), "limit of 1 ") {
+			t.Errorf("%s: message %q", tc.limit, e.Error())
+		}
+	}
+}
+
+func TestCacheEncryptedRestart(t *testing.T) {
+	p := t.TempDir()
+	d, err := OpenCacheDir("", CacheOptions{Path: p, MaxSize: 1 << 20, Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.Add("John", "a.txt", "en", "", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = d.Drain(ctx); err == nil {
+		t.Error("drained with a file not delivered")
+	}
+	// dead letters are not waited for
+	f.SetDead("dest", "failed")
+	if err = d.Drain(context.Background()); err != nil {
+		t.Error(err)
+	}
+	d.Close()
+
+	d, err = OpenCacheDir("", CacheOptions{Path: p, MaxSize: 1 << 20, Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// only the daily usage is kept
+	if len(d.Entries) != 0 || d.Size() != 0 || d.db.len() != 1 {
+		t.Errorf("%d entries, %d bytes, %d records left", len(d.Entries), d.Size(), d.db.len())
+	}
+	if _, err = os.Stat(f.(*CacheEntry).Cn); !os.IsNotExist(err) {
+		t.Error("content not removed:", err)
+	}
+}
+
+func TestSharedContent(t *testing.T) {
+	d := opentestcache(t, t.TempDir())
+	defer d.Close()
+	var v []*CacheEntry
+	for _, user := range []string{"John", "Anna"} {
+		f, err := d.Add(user, "a.txt", "en", "", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v = append(v, f.(*CacheEntry))
+	}
+	if v[0].Cn != v[1].Cn || v[0].ID() == v[1].ID() || d.Size() != 5 {
+		t.Fatalf("content not shared: %s, %s, size %d", v[0].Cn, v[1].Cn, d.Size())
+	}
+	if err := v[0].Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(v[1].Cn); err != nil || d.Size() != 5 {
+		t.Errorf("content removed with the first entry: %v, size %d", err, d.Size())
+	}
+	if err := v[1].Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(v[1].Cn); !os.IsNotExist(err) || d.Size() != 0 {
+		t.Errorf("content kept after the last entry: %v, size %d", err, d.Size())
+	}
+
+	// content encrypted in the cache is never shared with plain content
+	f, err := d.Add("John", "a.txt", "en", "", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := f.(*CacheEntry)
+	d.mtx.Lock()
+	e.Enc = true
+	d.mtx.Unlock()
+	f, err = d.Add("John", "b.txt", "en", "", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.(*CacheEntry).Cn == e.Cn || d.Size() != 10 {
+		t.Errorf("encrypted content shared, size %d", d.Size())
+	}
+}
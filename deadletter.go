@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// notbefore returns the time of the next upload attempt of f.
+func (u *Uploader) notbefore(f CachedFile) time.Time {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	if p, ok := u.pend[f]; ok {
+		return p.next
+	}
+	return time.Time{}
+}
+
+// backoff delays the next attempt of f after a temporary failure,
+// doubling the delay after each failed attempt. It returns false
+// if f has failed too many times and is not to be retried.
+func (u *Uploader) backoff(f CachedFile) bool {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	p, ok := u.pend[f]
+	if !ok {
+		p = new(pendingfile)
+		u.pend[f] = p
+	}
+	p.attempts++
+	if p.attempts >= u.maxattempts {
+		return false
+	}
+	d, max := u.faildelay, FTP_RETRY_MAX_DELAY
+	if max < d {
+		max = d
+	}
+	for i := 1; i < p.attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	p.next = time.Now().Add(d)
+	u.log.Println("Attempt", p.attempts, "of", f.User()+"/"+f.Filename(), "failed, retry in", d)
+	return true
+}
+
+// setdead moves f, already removed from the queue, to the dead letters.
+func (u *Uploader) setdead(f CachedFile, err error) {
+	u.log.Println("Upload of", f.User()+"/"+f.Filename(), "failed permanently, moved to dead letters:", err)
+	u.forget(f)
+	f.SetDead(u.Name, err.Error())
+	u.adddead(f)
+}
+
+func (u *Uploader) adddead(f CachedFile) {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	u.dead = append(u.dead, f)
+}
+
+// Deadletters returns the files that failed permanently.
+func (u *Uploader) Deadletters() []CachedFile {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	return append([]CachedFile(nil), u.dead...)
+}
+
+// Retry puts the dead letter f back to the queue.
+func (u *Uploader) Retry(f CachedFile) error {
+	if !u.removedead(f) {
+		return fmt.Errorf("%s is not a dead letter", f.ID())
+	}
+	u.log.Println("Retrying", f.User()+"/"+f.Filename())
+	f.SetDead(u.Name, "")
+	u.queue.push(f)
+	return nil
+}
+
+// Drop gives up delivering the dead letter f.
+func (u *Uploader) Drop(f CachedFile) error {
+	if !u.removedead(f) {
+		return fmt.Errorf("%s is not a dead letter", f.ID())
+	}
+	u.log.Println("Dropping", f.User()+"/"+f.Filename())
+	f.SetDead(u.Name, "")
+	u.delivered(u, f)
+	return nil
+}
+
+func (u *Uploader) removedead(f CachedFile) bool {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	for i, e := range u.dead {
+		if e == f {
+			u.dead = append(u.dead[:i], u.dead[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Deadletter is a file that can't be delivered to a destination.
+type Deadletter struct {
+	Dest   string
+	File   CachedFile
+	Reason string
+}
+
+// Deadletters returns the dead letters of all destinations.
+func (d *Delivery) Deadletters() []Deadletter {
+	var v []Deadletter
+	for _, u := range d.Uploaders {
+		for _, f := range u.Deadletters() {
+			v = append(v, Deadletter{u.Name, f, f.Dead(u.Name)})
+		}
+	}
+	return v
+}
+
+// Retry puts the dead letter with the cache id back to the queue of
+// the destination dest, or of all destinations if dest is empty.
+func (d *Delivery) Retry(dest, id string) error {
+	return d.deadletter(dest, id, (*Uploader).Retry)
+}
+
+// Drop gives up delivering the dead letter with the cache id
+// to dest, or to all destinations if dest is empty.
+func (d *Delivery) Drop(dest, id string) error {
+	return d.deadletter(dest, id, (*Uploader).Drop)
+}
+
+func (d *Delivery) deadletter(dest, id string, fn func(u *Uploader, f CachedFile) error) error {
+	found := false
+	for _, u := range d.Uploaders {
+		if dest != "" && dest != u.Name {
+			continue
+		}
+		for _, f := range u.Deadletters() {
+			if f.ID() == id {
+				found = true
+				if err := fn(u, f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+	return nil
+}
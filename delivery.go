@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// Delivery sends cached files to every destination. A cached file is
+// discarded once all destinations have confirmed it.
+type Delivery struct {
+	Uploaders []*Uploader
+
+	mtx sync.Mutex
+}
+
+// NewDelivery creates an uploader for each destination. The
+// encrypted copies of files are made in tmp.
+func NewDelivery(dests []DestConfig, tmp *CacheDir) (*Delivery, error) {
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("no destination specified")
+	}
+	d := &Delivery{}
+	names := make(map[string]bool)
+	for _, c := range dests {
+		u, err := NewUploader(c, d.delivered)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("%s: %v", destname(c), err)
+		}
+		if names[u.Name] {
+			u.Close()
+			d.Close()
+			return nil, fmt.Errorf("destination name %s is not unique", u.Name)
+		}
+		names[u.Name] = true
+		u.tmp = tmp
+		d.Uploaders = append(d.Uploaders, u)
+	}
+	if len(d.Uploaders) > 1 {
+		for _, u := range d.Uploaders {
+			u.setlogprefix(u.log.Prefix() + u.Name + " ")
+		}
+	}
+	return d, nil
+}
+
+// Add queues f for all destinations it hasn't been delivered to yet.
+// Files that are dead letters for a destination are not queued again.
+func (d *Delivery) Add(f CachedFile) error {
+	if _, err := Encodename(f.User()); err != nil {
+		return err
+	}
+	pending := false
+	for _, u := range d.Uploaders {
+		switch {
+		case f.Delivered(u.Name):
+		case f.Dead(u.Name) != "":
+			u.adddead(f)
+			pending = true
+		default:
+			if err := u.Add(f); err != nil {
+				return err
+			}
+			pending = true
+		}
+	}
+	if !pending {
+		f.Discard()
+	}
+	return nil
+}
+
+func (d *Delivery) Close() error {
+	for _, u := range d.Uploaders {
+		u.Close()
+	}
+	return nil
+}
+
+// Shutdown stops all uploaders and waits for the files being uploaded.
+// Uploads still in progress when ctx is done are aborted.
+func (d *Delivery) Shutdown(ctx context.Context) error {
+	d.Close()
+	var err error
+	for _, u := range d.Uploaders {
+		if e := u.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Rescan refreshes the list of uploaded files on all destinations.
+func (d *Delivery) Rescan() {
+	for _, u := range d.Uploaders {
+		u.Rescan()
+	}
+}
+
+// Userfiles returns the files of uploader found on any of the destinations.
+func (d *Delivery) Userfiles(uploader string) []string {
+	m := make(map[string]bool)
+	var r []string
+	for _, u := range d.Uploaders {
+		for _, fn := range u.Userfiles(uploader) {
+			if !m[fn] {
+				m[fn] = true
+				r = append(r, fn)
+			}
+		}
+	}
+	return r
+}
+
+// delivered is called by the uploader u after f has been uploaded.
+func (d *Delivery) delivered(u *Uploader, f CachedFile) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	f.SetDelivered(u.Name)
+	for _, u := range d.Uploaders {
+		if !f.Delivered(u.Name) {
+			return
+		}
+	}
+	f.Discard()
+}
+
+// destname returns the name used for the destination in logs
+// and in the cache, the URL without password by default.
+func destname(c DestConfig) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if u, err := url.Parse(c.URL); err == nil {
+		return u.Redacted()
+	}
+	return c.URL
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Destination is the remote side of an Uploader. Paths are
+// relative to the remote directory specified in the URL.
+type Destination interface {
+	// Connect opens a connection to the remote side.
+	Connect() error
+
+	// Disconnect closes an open connection.
+	Disconnect() error
+
+	// Connected reports whether there is an open connection.
+	Connected() bool
+
+	// Store saves size bytes of content as filename in userdir.
+	// The user directory is created if necessary.
+	Store(userdir, filename string, r io.Reader, size int64) error
+
+	// List returns the names of the entries in dir,
+	// use "." to list the remote directory itself.
+	List(dir string) ([]string, error)
+}
+
+// Resumer is implemented by destinations that can continue
+// interrupted uploads instead of starting from the beginning.
+type Resumer interface {
+	// StoredSize returns the size of filename in userdir.
+	StoredSize(userdir, filename string) (int64, error)
+
+	// StoreFrom writes the content to filename in userdir,
+	// starting at offset. It returns ErrNoResume if the
+	// remote side turns out not to support resuming.
+	StoreFrom(userdir, filename string, r io.Reader, offset int64) error
+}
+
+var ErrNoResume = fmt.Errorf("resume not supported")
+
+// Checker is implemented by destinations that can check stored files.
+type Checker interface {
+	// Check returns the size of filename in userdir, or -1 if
+	// the size is not available, and its hex encoded SHA-256
+	// sum, or an empty string if it can't be calculated.
+	Check(userdir, filename string) (size int64, sum string, err error)
+}
+
+// Fetcher is implemented by destinations able to read back stored files.
+type Fetcher interface {
+	// Fetch opens filename in userdir for reading.
+	Fetch(userdir, filename string) (io.ReadCloser, error)
+}
+
+// Renamer is implemented by destinations whose Store is not atomic,
+// and can rename files instead.
+type Renamer interface {
+	// Rename renames from to to in userdir, replacing to if it exists.
+	Rename(userdir, from, to string) error
+}
+
+// Classifier is implemented by destinations able to tell failures
+// caused by the file itself, such as a refused permission, from
+// failures of the destination.
+type Classifier interface {
+	// Permanent reports if Store or StoreFrom failed with err
+	// because of the file, so retrying it is pointless.
+	Permanent(err error) bool
+}
+
+// Keeper is implemented by destinations able to keep an idle connection open.
+type Keeper interface {
+	// Keepalive sends a command doing nothing on the connection.
+	Keepalive() error
+}
+
+// DestConfig describes a destination in config.json.
+type DestConfig struct {
+	URL string
+
+	// Name identifies the destination in logs and in the
+	// delivery state of cached files. Defaults to URL without password.
+	Name string
+
+	// Number of parallel uploads, each using its own connection.
+	Workers int
+
+	// Interval of refreshing the list of uploaded files from the
+	// remote side, eg. "30m". Defaults to 10 minutes, "0" disables.
+	Rescan string
+
+	// What to do with files already existing on the remote side:
+	// "overwrite" (default), "skip", "rename" or "timestamp".
+	Collision string
+
+	// Template of the remote directory of uploaded files,
+	// "uplood-{user_ascii}" by default.
+	Layout string
+
+	// Bandwidth limit in bytes/s (eg. "500k"), unlimited if empty.
+	// The limit of the first matching rule of Schedule is used instead,
+	// if any. No new uploads are started during Pause periods.
+	Bandwidth string
+	Schedule  []BandwidthRule
+	Pause     []Period
+
+	// Delays before reconnecting after a failed connection attempt,
+	// before disconnecting when idle, and before the first retry of
+	// a failed upload, eg. "30s". Each defaults to one minute.
+	ReconnectDelay  string
+	DisconnectDelay string
+	FailDelay       string
+
+	// Failed upload attempts of a file before it is moved to the
+	// dead letters, 20 by default.
+	MaxAttempts int
+
+	// Timeout of connecting (default 30s) for FTP and SFTP, and of
+	// each read and write on FTP connections (none by default).
+	DialTimeout    string
+	CommandTimeout string
+
+	// FTP data connection mode: "epsv" (default, falls back to PASV
+	// if the server doesn't support it), "pasv" or "active" (PORT or
+	// EPRT). PassiveHost is connected to for data connections instead
+	// of the address sent by the server, eg. when it is behind NAT.
+	FTPMode     string
+	PassiveHost string
+
+	// Interval of sending NOOP on idle FTP connections, eg. "20s".
+	// Disabled by default.
+	Keepalive string
+
+	// Hooks run after a file is delivered: a command with the file
+	// details in UPLOAD_* environment variables, and a webhook URL
+	// receiving a POST of a JSON DeliveryEvent.
+	HookCommand []string
+	Webhook     string
+
+	// Format of the manifest listing delivered files kept in each
+	// remote directory: "json" (manifest.json) or "csv" (manifest.csv).
+	// Disabled by default.
+	Manifest string
+
+	// Files are encrypted before upload to age recipients (age1...),
+	// or to the OpenPGP public keys in an armored keyring file, and
+	// stored with a .age or .gpg suffix.
+	AgeRecipients []string
+	PGPKeyring    string
+
+	// Don't upload a file if the same content has already been
+	// delivered for the user during this run, or is listed in the
+	// manifest of the remote directory.
+	SkipDuplicates bool
+
+	// SFTP private key file, and its passphrase if encrypted.
+	PrivateKey           string
+	PrivateKeyPassphrase string
+
+	// SFTP host key in authorized_keys format,
+	// or as a SHA256 fingerprint (SHA256:...).
+	HostKey string
+
+	// TLS options: PEM encoded CA bundle to verify the server with
+	// instead of the system roots, and client certificate and key.
+	CACert             string
+	ClientCert         string
+	ClientKey          string
+	InsecureSkipVerify bool
+
+	// S3 endpoint URL (default https://s3.amazonaws.com), region,
+	// path-style bucket addressing and multipart upload part size.
+	Endpoint  string
+	Region    string
+	PathStyle bool
+	PartSize  string
+}
+
+// NewDestination creates a destination for the URL in c.
+func NewDestination(c DestConfig, l *log.Logger) (Destination, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ftp" && u.Scheme != "ftps" {
+		if c.CommandTimeout != "" || c.FTPMode != "" || c.PassiveHost != "" || c.Keepalive != "" {
+			return nil, fmt.Errorf("CommandTimeout, FTPMode, PassiveHost and Keepalive are only valid for ftp:// and ftps://")
+		}
+	}
+	switch u.Scheme {
+	case "ftp", "ftps":
+		return newFTPDestination(u, c, l)
+	case "sftp":
+		return newSFTPDestination(u, c, l)
+	case "file":
+		return newLocalDestination(u, l)
+	case "s3":
+		return newS3Destination(u, c, l)
+	case "dav", "davs":
+		return newWebDAVDestination(u, c, l)
+	}
+	return nil, fmt.Errorf("URL scheme '%s' not supported", u.Scheme)
+}
+
+// configduration parses the duration s, returning def if s is empty.
+func configduration(name, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return d, nil
+}
+
+// urlhost returns the host from u, with port added if u has none.
+func urlhost(u *url.URL, port string) string {
+	addr := u.Host
+	if strings.IndexRune(addr, ':') == -1 {
+		addr += ":" + port
+	}
+	return addr
+}
+
+// urlcredentials returns the username and password from u.
+// The password defaults to defpass if a username is specified without one.
+func urlcredentials(u *url.URL, defpass string) (user, pass string) {
+	if u.User != nil {
+		user = u.User.Username()
+		var ok bool
+		if pass, ok = u.User.Password(); !ok {
+			pass = defpass
+		}
+	}
+	return
+}
+
+// tlsconfig creates the TLS configuration for connecting to host.
+func tlsconfig(c DestConfig, host string, l *log.Logger) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if !cs.DidResume {
+				l.Printf("TLS handshake with %s done: %s, %s", host,
+					tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+			}
+			return nil
+		},
+	}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.InsecureSkipVerify {
+		l.Println("Warning: TLS certificate verification disabled for", host)
+	}
+	return cfg, nil
+}
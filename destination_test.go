@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestPermanent(t *testing.T) {
+	for _, tc := range []struct {
+		dest Classifier
+		err  error
+		want bool
+	}{
+		{&localDestination{}, &os.PathError{Op: "open", Path: "x", Err: syscall.EACCES}, true},
+		{&localDestination{}, &os.LinkError{Op: "rename", Old: "x", New: "y", Err: syscall.EPERM}, true},
+		{&localDestination{}, &os.PathError{Op: "mkdir", Path: "x", Err: syscall.EACCES}, false},
+		{&localDestination{}, &os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, false},
+		{&sftpDestination{}, &os.PathError{Op: "create", Path: "x", Err: os.ErrPermission}, true},
+		{&sftpDestination{}, os.ErrPermission, false},
+		{&sftpDestination{}, errors.New("connection lost"), false},
+		{&s3Destination{}, minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, true},
+		{&s3Destination{}, minio.ErrorResponse{Code: "EntityTooLarge", StatusCode: 400}, true},
+		{&s3Destination{}, minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, false},
+		{&s3Destination{}, fmt.Errorf("connection refused"), false},
+		{&webdavDestination{}, gowebdav.NewPathError("WriteStream", "x", 403), true},
+		{&webdavDestination{}, gowebdav.NewPathError("WriteStream", "x", 413), true},
+		{&webdavDestination{}, gowebdav.NewPathError("WriteStream", "x", 507), false},
+		{&webdavDestination{}, gowebdav.NewPathError("Mkdir", "x", 403), false},
+	} {
+		if got := tc.dest.Permanent(tc.err); got != tc.want {
+			t.Errorf("%T: Permanent(%v) = %v, want %v", tc.dest, tc.err, got, tc.want)
+		}
+	}
+}
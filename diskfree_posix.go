@@ -0,0 +1,15 @@
+// +build !windows
+
+package main
+
+import "syscall"
+
+// diskfree returns the bytes available to the user on the
+// file system of path.
+func diskfree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/openpgp"
+)
+
+// encrypter encrypts files before upload.
+type encrypter interface {
+	// suffix returns the suffix added to remote filenames.
+	suffix() string
+
+	// encrypt returns a writer encrypting to w, the
+	// result is complete when the writer is closed.
+	encrypt(w io.Writer, filename string) (io.WriteCloser, error)
+}
+
+// newencrypter returns the encrypter for the
+// recipients in c, or nil if encryption is disabled.
+func newencrypter(c DestConfig) (encrypter, error) {
+	switch {
+	case len(c.AgeRecipients) != 0 && c.PGPKeyring != "":
+		return nil, fmt.Errorf("AgeRecipients and PGPKeyring are mutually exclusive")
+	case len(c.AgeRecipients) != 0:
+		e := new(ageencrypter)
+		for _, s := range c.AgeRecipients {
+			r, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid age recipient %s: %v", s, err)
+			}
+			e.recipients = append(e.recipients, r)
+		}
+		return e, nil
+	case c.PGPKeyring != "":
+		f, err := os.Open(c.PGPKeyring)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		keys, err := openpgp.ReadArmoredKeyRing(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenPGP keyring %s: %v", c.PGPKeyring, err)
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no keys in OpenPGP keyring %s", c.PGPKeyring)
+		}
+		return &pgpencrypter{keys}, nil
+	}
+	return nil, nil
+}
+
+type ageencrypter struct {
+	recipients []age.Recipient
+}
+
+func (e *ageencrypter) suffix() string { return ".age" }
+
+func (e *ageencrypter) encrypt(w io.Writer, filename string) (io.WriteCloser, error) {
+	return age.Encrypt(w, e.recipients...)
+}
+
+type pgpencrypter struct {
+	keys openpgp.EntityList
+}
+
+func (e *pgpencrypter) suffix() string { return ".gpg" }
+
+func (e *pgpencrypter) encrypt(w io.Writer, filename string) (io.WriteCloser, error) {
+	return openpgp.Encrypt(w, e.keys, nil, &openpgp.FileHints{IsBinary: true, FileName: filename}, nil)
+}
+
+// suffix returns the suffix of encrypted remote files, if encryption is enabled.
+func (u *Uploader) suffix() string {
+	if u.enc == nil {
+		return ""
+	}
+	return u.enc.suffix()
+}
+
+// displayname returns the remote filename fn without the encryption suffix.
+func (u *Uploader) displayname(fn string) string {
+	if sfx := u.suffix(); sfx != "" && strings.HasSuffix(fn, sfx) && len(fn) > len(sfx) {
+		return fn[:len(fn)-len(sfx)]
+	}
+	return fn
+}
+
+// payload is the content uploaded for a file: the cached
+// content, or its encrypted copy if encryption is enabled.
+type payload struct {
+	r    io.ReadSeekCloser
+	size int64
+	sum  string
+}
+
+// storedsum returns the size and SHA-256 of the remote file of f,
+// those of its encrypted copy if it is encrypted.
+func (p *pendingfile) storedsum(f CachedFile) (int64, string) {
+	if p.enc != nil {
+		return p.enc.size, p.enc.sum
+	}
+	return f.Size(), f.Sum()
+}
+
+// encryptedcopy is an encrypted copy of a cached file, kept
+// in the cache directory between upload attempts.
+type encryptedcopy struct {
+	name string
+	size int64
+	sum  string
+}
+
+// payload returns the payload to upload for f with content,
+// encrypting content first if needed. Content is closed if
+// the payload is an encrypted copy.
+func (w *worker) payload(f CachedFile, p *pendingfile, content io.ReadSeekCloser) (*payload, error) {
+	if w.u.enc == nil {
+		return &payload{content, f.Size(), f.Sum()}, nil
+	}
+	if p.enc == nil {
+		enc, err := w.u.encryptcopy(f, content)
+		if err != nil {
+			content.Close()
+			return nil, err
+		}
+		p.enc = enc
+		p.partial = false
+	}
+	content.Close()
+	r, err := os.Open(p.enc.name)
+	if err != nil {
+		return nil, err
+	}
+	return &payload{r, p.enc.size, p.enc.sum}, nil
+}
+
+// encryptcopy encrypts content into a temporary file in the cache directory.
+func (u *Uploader) encryptcopy(f CachedFile, content io.Reader) (enc *encryptedcopy, err error) {
+	if u.tmp == nil {
+		return nil, fmt.Errorf("no directory for encrypted copies")
+	}
+	tf, err := ioutil.TempFile(u.tmp.Path, "enc-")
+	if err != nil {
+		return nil, err
+	}
+	enc = &encryptedcopy{name: tf.Name()}
+	lw := NewLimitWriter(tf, templimiter{u.tmp})
+	defer func() {
+		tf.Close()
+		lw.Finish()
+		if err != nil {
+			os.Remove(enc.name)
+			enc = nil
+		}
+	}()
+	h := sha256.New()
+	cw := &countingwriter{w: io.MultiWriter(lw, h)}
+	ew, err := u.enc.encrypt(cw, f.Filename())
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(ew, content); err != nil {
+		return
+	}
+	if err = ew.Close(); err != nil {
+		return
+	}
+	if err = tf.Sync(); err != nil {
+		return
+	}
+	enc.size, enc.sum = cw.n, hex.EncodeToString(h.Sum(nil))
+	u.log.Println("Encrypted", f.User()+"/"+f.Filename(), "to", enc.size, "bytes")
+	return
+}
+
+// remove deletes the encrypted copy.
+func (enc *encryptedcopy) remove() {
+	os.Remove(enc.name)
+}
+
+type countingwriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingwriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// newcachekey returns a cipher with a new random key for the cache.
+func newcachekey() (cipher.Block, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(key)
+}
+
+// encryptwriter writes a random IV to f, and returns a
+// writer encrypting to w with AES-CTR.
+func encryptwriter(f io.Writer, w io.Writer, block cipher.Block) (io.Writer, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(iv); err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w}, nil
+}
+
+// ctrreader decrypts a file written by encryptwriter.
+type ctrreader struct {
+	f     *os.File
+	block cipher.Block
+	iv    []byte
+	s     cipher.Stream
+}
+
+func decryptreader(f *os.File, block cipher.Block) (*ctrreader, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(f, iv); err != nil {
+		return nil, err
+	}
+	return &ctrreader{f, block, iv, ctrstream(block, iv, 0)}, nil
+}
+
+func (r *ctrreader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.s.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (r *ctrreader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += aes.BlockSize
+	}
+	pos, err := r.f.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	if pos -= aes.BlockSize; pos < 0 {
+		r.f.Seek(aes.BlockSize, io.SeekStart)
+		r.s = ctrstream(r.block, r.iv, 0)
+		return 0, fmt.Errorf("seek before start of file")
+	}
+	r.s = ctrstream(r.block, r.iv, pos)
+	return pos, nil
+}
+
+func (r *ctrreader) Close() error {
+	return r.f.Close()
+}
+
+// ctrstream returns the CTR stream for iv positioned at pos.
+func ctrstream(block cipher.Block, iv []byte, pos int64) cipher.Stream {
+	ctr := append([]byte(nil), iv...)
+	// add the block number to the big-endian counter
+	n := uint64(pos / aes.BlockSize)
+	for i := len(ctr) - 1; i >= 0 && n != 0; i-- {
+		sum := uint64(ctr[i]) + n&0xff
+		ctr[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	s := cipher.NewCTR(block, ctr)
+	skip := make([]byte, pos%aes.BlockSize)
+	s.XORKeyStream(skip, skip)
+	return s
+}
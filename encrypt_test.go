@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCTRStream(t *testing.T) {
+	block, err := newcachekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ivs := [][]byte{
+		make([]byte, aes.BlockSize),
+		bytes.Repeat([]byte{0xff}, aes.BlockSize),
+		append(bytes.Repeat([]byte{0x12}, aes.BlockSize-3), 0xfe, 0xff, 0xf0),
+	}
+	mod := new(big.Int).Lsh(big.NewInt(1), 8*aes.BlockSize)
+	for _, iv := range ivs {
+		for _, pos := range []int64{0, 1, 15, 16, 17, 15 * 16, 16*16 + 3, 255 * 16, 256*16 + 5, 65535*16 + 1, 1 << 40} {
+			// the counter of the block at pos is iv + pos/16
+			n := new(big.Int).SetBytes(iv)
+			n.Add(n, big.NewInt(pos/aes.BlockSize)).Mod(n, mod)
+			ctr := make([]byte, aes.BlockSize)
+			n.FillBytes(ctr)
+			want := make([]byte, pos%aes.BlockSize+40)
+			cipher.NewCTR(block, ctr).XORKeyStream(want, want)
+			want = want[pos%aes.BlockSize:]
+
+			got := make([]byte, 40)
+			ctrstream(block, iv, pos).XORKeyStream(got, got)
+			if !bytes.Equal(got, want) {
+				t.Errorf("iv %x, pos %d: wrong key stream", iv, pos)
+			}
+		}
+	}
+}
+
+func TestCTRReaderSeek(t *testing.T) {
+	block, err := newcachekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	fn := filepath.Join(t.TempDir(), "enc")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := encryptwriter(f, f, block)
+	if err == nil {
+		_, err = w.Write(plain)
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err = os.Open(fn); err != nil {
+		t.Fatal(err)
+	}
+	r, err := decryptreader(f, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// each case reads 10 bytes after seeking, from at
+	for _, tc := range []struct {
+		offset  int64
+		whence  int
+		pos, at int64
+		fail    bool
+	}{
+		{37, io.SeekStart, 37, 37, false},
+		{5, io.SeekCurrent, 52, 52, false},
+		{-10, io.SeekCurrent, 52, 52, false},
+		{-10, io.SeekEnd, 90, 90, false},
+		{16, io.SeekStart, 16, 16, false},
+		// refused by the file, the position is kept
+		{-200, io.SeekCurrent, 0, 26, true},
+		// into the IV, back to the start
+		{-40, io.SeekCurrent, 0, 0, true},
+		{100, io.SeekStart, 100, 100, false},
+	} {
+		pos, err := r.Seek(tc.offset, tc.whence)
+		if (err != nil) != tc.fail || pos != tc.pos {
+			t.Errorf("Seek(%d, %d) = %d, %v, want %d", tc.offset, tc.whence, pos, err, tc.pos)
+			continue
+		}
+		want := plain[tc.at:]
+		if len(want) > 10 {
+			want = want[:10]
+		}
+		got, err := ioutil.ReadAll(io.LimitReader(r, 10))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Seek(%d, %d): read %v, %v, want %v", tc.offset, tc.whence, got, err, want)
+		}
+	}
+}
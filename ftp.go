@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpDestination stores files on an FTP server.
+type ftpDestination struct {
+	Addr, User, Pass, RemoteDir string
+
+	// TLS mode and config, TLS is not used when TLSMode is empty
+	TLSMode string
+	TLS     *tls.Config
+
+	DialTimeout time.Duration
+	CmdTimeout  time.Duration // timeout of reads and writes, 0 if none
+	DisableEPSV bool
+	Active      bool   // server connects for data connections
+	PassiveHost string // host for data connections, if not empty
+
+	log  *log.Logger
+	conn *ftp.ServerConn
+	ctl  *ftpcontrol // control connection of conn
+	hash string      // command returning the SHA-256 of files, if any
+}
+
+const (
+	FTP_TLS_IMPLICIT = "implicit"
+	FTP_TLS_EXPLICIT = "explicit"
+
+	FTP_MODE_EPSV   = "epsv"
+	FTP_MODE_PASV   = "pasv"
+	FTP_MODE_ACTIVE = "active"
+)
+
+func newFTPDestination(u *url.URL, c DestConfig, l *log.Logger) (*ftpDestination, error) {
+	user, pass := urlcredentials(u, "anonymous")
+	d := &ftpDestination{
+		User:      user,
+		Pass:      pass,
+		RemoteDir: u.Path,
+		log:       l,
+	}
+	port := "21"
+	switch mode := u.Query().Get("tls"); {
+	case u.Scheme == "ftps":
+		if mode != "" && mode != FTP_TLS_IMPLICIT {
+			return nil, fmt.Errorf("tls=%s invalid for ftps://", mode)
+		}
+		d.TLSMode, port = FTP_TLS_IMPLICIT, "990"
+	case mode == FTP_TLS_EXPLICIT:
+		d.TLSMode = mode
+	case mode != "":
+		return nil, fmt.Errorf("tls=%s invalid for ftp://, use tls=%s or ftps://", mode, FTP_TLS_EXPLICIT)
+	}
+	d.Addr = urlhost(u, port)
+	var err error
+	if d.DialTimeout, err = configduration("dial timeout", c.DialTimeout, ftp.DefaultDialTimeout); err != nil {
+		return nil, err
+	}
+	if d.CmdTimeout, err = configduration("command timeout", c.CommandTimeout, 0); err != nil {
+		return nil, err
+	}
+	switch c.FTPMode {
+	case "", FTP_MODE_EPSV:
+	case FTP_MODE_PASV:
+		d.DisableEPSV = true
+	case FTP_MODE_ACTIVE:
+		d.Active = true
+	default:
+		return nil, fmt.Errorf("invalid FTP mode: %s", c.FTPMode)
+	}
+	if c.PassiveHost != "" {
+		if d.Active {
+			return nil, fmt.Errorf("passive host is not used in active mode")
+		}
+		if strings.ContainsAny(c.PassiveHost, ":/") && net.ParseIP(c.PassiveHost) == nil {
+			return nil, fmt.Errorf("invalid passive host: %s", c.PassiveHost)
+		}
+		d.PassiveHost = c.PassiveHost
+	}
+	if d.TLSMode != "" {
+		if d.TLS, err = tlsconfig(c, u.Hostname(), l); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *ftpDestination) Connect() error {
+	opts := []ftp.DialOption{
+		ftp.DialWithDialFunc(d.dialfunc()),
+		ftp.DialWithDisabledEPSV(d.DisableEPSV),
+	}
+	if d.TLS != nil {
+		// TLS is started by the dial function, the library
+		// only protects the data connections
+		opts = append(opts, ftp.DialWithTLS(d.TLS))
+	}
+	conn, err := ftp.Dial(d.Addr, opts...)
+	if err != nil {
+		if d.TLSMode != "" {
+			d.log.Println("Connection failed (TLS "+d.TLSMode+"):", err)
+		} else {
+			d.log.Println("Connection failed:", err)
+		}
+		return err
+	}
+	d.log.Println("Logging in", d.User)
+	if err = conn.Login(d.User, d.Pass); err != nil {
+		d.log.Println("Login failed:", err)
+		conn.Quit()
+		return err
+	}
+	d.log.Println("Login successful")
+	d.conn = conn
+	d.hash = d.hashcommand()
+	return nil
+}
+
+// hashcommand returns HASH or XSHA256 if the server has one of them
+// to get the SHA-256 of files, selecting SHA-256 for HASH if needed.
+func (d *ftpDestination) hashcommand() string {
+	code, msg, err := d.ctl.cmd("FEAT")
+	if err != nil || code != ftp.StatusSystem {
+		return ""
+	}
+	xsha := false
+	for _, line := range strings.Split(msg, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || !strings.HasPrefix(line, " ") {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "HASH":
+			if len(f) < 2 {
+				continue
+			}
+			for _, alg := range strings.Split(strings.ToUpper(f[1]), ";") {
+				switch alg {
+				case "SHA-256*":
+					return "HASH"
+				case "SHA-256":
+					code, msg, err := d.ctl.cmd("OPTS HASH SHA-256")
+					if err == nil && code == ftp.StatusCommandOK {
+						return "HASH"
+					}
+					d.log.Println("Selecting SHA-256 for HASH failed:", code, msg, err)
+				}
+			}
+		case "XSHA256":
+			xsha = true
+		}
+	}
+	if xsha {
+		return "XSHA256"
+	}
+	return ""
+}
+
+func (d *ftpDestination) Disconnect() error {
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.Quit()
+	d.conn, d.ctl = nil, nil
+	return err
+}
+
+func (d *ftpDestination) Connected() bool {
+	return d.conn != nil
+}
+
+// Keepalive sends NOOP.
+func (d *ftpDestination) Keepalive() error {
+	return d.conn.NoOp()
+}
+
+// dialfunc returns the function opening the control connection on
+// the first call, and data connections afterwards. It applies the
+// timeouts, the passive host and active mode, and does TLS.
+func (d *ftpDestination) dialfunc() func(network, addr string) (net.Conn, error) {
+	control := true
+	return func(network, addr string) (net.Conn, error) {
+		if control {
+			control = false
+			return d.dialcontrol(network, addr)
+		}
+		if d.Active {
+			return d.ctl.dataconn(d.DialTimeout, d.dataconn), nil
+		}
+		if d.PassiveHost != "" {
+			if _, port, err := net.SplitHostPort(addr); err == nil {
+				addr = net.JoinHostPort(d.PassiveHost, port)
+			}
+		}
+		dialer := net.Dialer{Timeout: d.DialTimeout}
+		conn, err := dialer.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return d.dataconn(conn), nil
+	}
+}
+
+// dialcontrol opens the control connection. With explicit TLS, the
+// connection is upgraded using AUTH TLS before the library gets it.
+func (d *ftpDestination) dialcontrol(network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.DialTimeout}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.CmdTimeout > 0 {
+		conn = &timeoutconn{conn, d.CmdTimeout}
+	}
+	if d.TLSMode == FTP_TLS_IMPLICIT {
+		conn = tls.Client(conn, d.TLS)
+	}
+	ctl := newftpcontrol(conn, d.Active)
+	if d.TLSMode == FTP_TLS_EXPLICIT {
+		if err = ctl.authtls(d.TLS); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	d.ctl = ctl
+	return ctl, nil
+}
+
+// dataconn applies the timeout and TLS to a data connection.
+func (d *ftpDestination) dataconn(conn net.Conn) net.Conn {
+	if d.CmdTimeout > 0 {
+		conn = &timeoutconn{conn, d.CmdTimeout}
+	}
+	if d.TLS != nil {
+		conn = tls.Client(conn, d.TLS)
+	}
+	return conn
+}
+
+// timeoutconn is a connection failing if a read
+// or write doesn't complete within timeout.
+type timeoutconn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutconn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutconn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+func (d *ftpDestination) Store(userdir, filename string, r io.Reader, size int64) error {
+	if err := d.cduser(userdir); err != nil {
+		return err
+	}
+	return d.filereply(d.conn.Stor(filename, r))
+}
+
+// StoredSize uses SIZE to get the size of the remote file.
+func (d *ftpDestination) StoredSize(userdir, filename string) (int64, error) {
+	if err := d.cdremote(); err != nil {
+		return 0, err
+	}
+	return d.conn.FileSize(userdir + "/" + filename)
+}
+
+// Check uses SIZE to check the remote file, and HASH or XSHA256
+// to get its SHA-256 if the server supports one of them.
+func (d *ftpDestination) Check(userdir, filename string) (int64, string, error) {
+	size, err := d.StoredSize(userdir, filename)
+	if notimplemented(err) {
+		size, err = -1, nil
+	}
+	if err != nil || d.hash == "" {
+		return size, "", err
+	}
+	code, msg, err := d.ctl.cmd("%s %s", d.hash, userdir+"/"+filename)
+	if err != nil {
+		return size, "", err
+	}
+	sum := hashreply(msg)
+	if code != ftp.StatusFile || sum == "" {
+		d.log.Println(d.hash, "of", userdir+"/"+filename, "failed:", code, msg)
+		return size, "", nil
+	}
+	return size, sum, nil
+}
+
+// hashreply returns the SHA-256 in the reply to HASH, eg.
+// "SHA-256 0-5 2cf24dba...9824 hello.txt", or to XSHA256.
+func hashreply(msg string) string {
+	for _, f := range strings.Fields(msg) {
+		if len(f) != sha256.Size*2 {
+			continue
+		}
+		if _, err := hex.DecodeString(f); err == nil {
+			return strings.ToLower(f)
+		}
+	}
+	return ""
+}
+
+// StoreFrom resumes the upload using REST and STOR,
+// or using APPE if the server doesn't support REST.
+func (d *ftpDestination) StoreFrom(userdir, filename string, r io.Reader, offset int64) error {
+	if err := d.cduser(userdir); err != nil {
+		return err
+	}
+	err := d.conn.StorFrom(filename, r, uint64(offset))
+	if notimplemented(err) {
+		d.log.Println("REST failed, trying APPE:", err)
+		err = d.conn.Append(filename, r)
+		if notimplemented(err) {
+			d.log.Println("APPE failed:", err)
+			return ErrNoResume
+		}
+	}
+	return d.filereply(err)
+}
+
+// Fetch uses RETR, the file must be read to the end and closed
+// before using the connection again.
+func (d *ftpDestination) Fetch(userdir, filename string) (io.ReadCloser, error) {
+	if err := d.cdremote(); err != nil {
+		return nil, err
+	}
+	return d.conn.Retr(userdir + "/" + filename)
+}
+
+// Rename uses RNFR and RNTO, deleting to first if the server
+// doesn't allow replacing it.
+func (d *ftpDestination) Rename(userdir, from, to string) error {
+	if err := d.cdremote(); err != nil {
+		return err
+	}
+	from, to = userdir+"/"+from, userdir+"/"+to
+	err := d.conn.Rename(from, to)
+	if replyerror(err) {
+		if errd := d.conn.Delete(to); errd == nil {
+			err = d.conn.Rename(from, to)
+		}
+	}
+	return err
+}
+
+func (d *ftpDestination) List(dir string) ([]string, error) {
+	if err := d.cdremote(); err != nil {
+		return nil, err
+	}
+	return d.conn.NameList(dir)
+}
+
+func (d *ftpDestination) cduser(userdir string) error {
+	if err := d.cdremote(); err != nil {
+		return err
+	}
+	for i, c := range userdir {
+		if c == '/' {
+			d.conn.MakeDir(userdir[:i]) // parent, may exist
+		}
+	}
+	errmk := d.conn.MakeDir(userdir) // don't check, may exist
+	if err := d.conn.ChangeDir(userdir); err != nil {
+		d.log.Println("Creating/changing to directory", userdir, "failed:", errmk, err)
+		return err
+	}
+	return nil
+}
+
+func (d *ftpDestination) cdremote() error {
+	err := d.conn.ChangeDir(d.RemoteDir)
+	if err != nil {
+		d.log.Println("CD to remote dir", d.RemoteDir, "failed:", err)
+	}
+	return err
+}
+
+// notimplemented reports if err is a reply to a
+// command not implemented or not understood by the server.
+func notimplemented(err error) bool {
+	if e, ok := err.(*textproto.Error); ok {
+		switch e.Code {
+		case ftp.StatusBadCommand, ftp.StatusBadArguments,
+			ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
+			return true
+		}
+	}
+	return false
+}
+
+// fileerror is the reply of the FTP server to STOR or APPE,
+// refusing to store the file.
+type fileerror struct {
+	reply *textproto.Error
+}
+
+func (e *fileerror) Error() string {
+	return e.reply.Error()
+}
+
+// filereply returns err as a fileerror, if it
+// contains the reply to STOR or APPE.
+func (d *ftpDestination) filereply(err error) error {
+	var e *textproto.Error
+	if err != nil && (d.ctl.last == "STOR" || d.ctl.last == "APPE") && errors.As(err, &e) {
+		return &fileerror{e}
+	}
+	return err
+}
+
+// replyerror reports if err is a reply from the FTP
+// server, meaning the connection is still usable.
+func replyerror(err error) bool {
+	switch err.(type) {
+	case *textproto.Error, *fileerror:
+		return true
+	}
+	return false
+}
+
+// Permanent reports if err is a permanent failure to store a file,
+// an FTP 5xx reply to STOR or APPE, so retrying is pointless. Failures
+// of other commands, such as logging in or changing to the directory
+// of the user, are failures of the destination and are retried.
+func (d *ftpDestination) Permanent(err error) bool {
+	e, ok := err.(*fileerror)
+	return ok && e.reply.Code >= 500 && e.reply.Code < 600
+}
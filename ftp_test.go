@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testftpserver is a minimal FTP server storing files in memory.
+// It supports active mode only, and AUTH TLS if tls is set, or
+// implicit TLS if implicit is set too.
+type testftpserver struct {
+	ln       net.Listener
+	tls      *tls.Config
+	implicit bool
+	mtx      sync.Mutex
+	files    map[string][]byte
+	deny     map[string]bool // names refused by STOR and CWD
+	feat     []string        // lines of the FEAT reply
+}
+
+func newtestftpserver(t *testing.T) *testftpserver {
+	return newtestftpsserver(t, nil, false)
+}
+
+// newtestftpsserver starts a server using TLS with cfg, implicit
+// TLS if implicit is set. TLS is disabled if cfg is nil.
+func newtestftpsserver(t *testing.T, cfg *tls.Config, implicit bool) *testftpserver {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testftpserver{ln: ln, tls: cfg, implicit: implicit, files: make(map[string][]byte), deny: make(map[string]bool)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testftpserver) url() string {
+	switch {
+	case s.implicit:
+		return "ftps://user:pass@" + s.ln.Addr().String() + "/"
+	case s.tls != nil:
+		return "ftp://user:pass@" + s.ln.Addr().String() + "/?tls=explicit"
+	}
+	return "ftp://user:pass@" + s.ln.Addr().String() + "/"
+}
+
+func (s *testftpserver) file(name string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	b, ok := s.files[name]
+	return b, ok
+}
+
+func (s *testftpserver) serve(conn net.Conn) {
+	defer conn.Close()
+	if s.implicit {
+		conn = tls.Server(conn, s.tls)
+	}
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 ready")
+	var dataaddr string
+	prot := false  // data connections use TLS
+	alg := "SHA-1" // algorithm of HASH
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			reply("331 password")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			if len(s.feat) == 0 {
+				reply("502 no features")
+				continue
+			}
+			reply("211-Features:")
+			for _, f := range s.feat {
+				reply(" %s", f)
+			}
+			reply("211 End")
+		case "AUTH":
+			if s.tls == nil {
+				reply("502 no TLS")
+				continue
+			}
+			reply("234 go ahead")
+			tc := tls.Server(conn, s.tls)
+			conn, r = tc, bufio.NewReader(tc)
+		case "PROT":
+			prot = arg == "P"
+			reply("200 ok")
+		case "OPTS":
+			if strings.HasPrefix(strings.ToUpper(arg), "HASH ") {
+				alg = strings.ToUpper(arg[5:])
+			}
+			reply("200 ok")
+		case "TYPE", "PBSZ":
+			reply("200 ok")
+		case "CWD":
+			if s.deny[arg] {
+				reply("550 no such directory")
+				continue
+			}
+			reply("250 ok")
+		case "MKD":
+			reply("257 created")
+		case "PORT":
+			v := strings.Split(arg, ",")
+			p1, _ := strconv.Atoi(v[4])
+			p2, _ := strconv.Atoi(v[5])
+			dataaddr = net.JoinHostPort(strings.Join(v[:4], "."), strconv.Itoa(p1*256+p2))
+			reply("200 ok")
+		case "EPRT":
+			v := strings.Split(arg, "|")
+			dataaddr = net.JoinHostPort(v[2], v[3])
+			reply("200 ok")
+		case "STOR":
+			if s.deny[arg] {
+				reply("553 not allowed")
+				continue
+			}
+			dc, err := net.Dial("tcp", dataaddr)
+			if err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			reply("150 ok")
+			if prot {
+				dc = tls.Server(dc, s.tls)
+			}
+			b, err := ioutil.ReadAll(dc)
+			dc.Close()
+			if err != nil {
+				reply("426 aborted")
+				continue
+			}
+			s.mtx.Lock()
+			s.files[arg] = b
+			s.mtx.Unlock()
+			reply("226 done")
+		case "SIZE":
+			if b, ok := s.file(path.Base(arg)); ok {
+				reply("213 %d", len(b))
+			} else {
+				reply("550 not found")
+			}
+		case "HASH", "XSHA256":
+			b, ok := s.file(path.Base(arg))
+			switch {
+			case !ok:
+				reply("550 not found")
+			case cmd == "XSHA256":
+				reply("213 %x", sha256.Sum256(b))
+			case alg == "SHA-256":
+				reply("213 SHA-256 0-%d %x %s", len(b), sha256.Sum256(b), arg)
+			default:
+				reply("213 %s 0-%d %x %s", alg, len(b), sha1.Sum(b), arg)
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// testcert returns a self-signed certificate for 127.0.0.1.
+func testcert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newtestftpdest(t *testing.T, s *testftpserver) *ftpDestination {
+	d, err := connecttestftp(t, s, DestConfig{InsecureSkipVerify: s.tls != nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// connecttestftp connects to s in active mode with the TLS settings of c.
+func connecttestftp(t *testing.T, s *testftpserver, c DestConfig) (*ftpDestination, error) {
+	u, err := url.Parse(s.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.FTPMode, c.DialTimeout = FTP_MODE_ACTIVE, "5s"
+	d, err := newFTPDestination(u, c, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return nil, err
+	}
+	if err = d.Connect(); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { d.Disconnect() })
+	return d, nil
+}
+
+func TestFTPActiveMode(t *testing.T) {
+	testftpactive(t, newtestftpserver(t))
+}
+
+func TestFTPActiveModeTLS(t *testing.T) {
+	testftpactive(t, newtestftpsserver(t, &tls.Config{Certificates: []tls.Certificate{testcert(t)}}, false))
+}
+
+func TestFTPActiveModeImplicitTLS(t *testing.T) {
+	testftpactive(t, newtestftpsserver(t, &tls.Config{Certificates: []tls.Certificate{testcert(t)}}, true))
+}
+
+func TestFTPSVerify(t *testing.T) {
+	cert, other := testcert(t), testcert(t)
+	dir := t.TempDir()
+	capem, otherpem := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "other.pem")
+	for fn, c := range map[string]tls.Certificate{capem: cert, otherpem: other} {
+		b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]})
+		if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, implicit := range []bool{false, true} {
+		s := newtestftpsserver(t, &tls.Config{Certificates: []tls.Certificate{cert}}, implicit)
+		for _, tc := range []struct {
+			c  DestConfig
+			ok bool
+		}{
+			{DestConfig{}, false},
+			{DestConfig{CACert: capem}, true},
+			{DestConfig{CACert: otherpem}, false},
+			{DestConfig{InsecureSkipVerify: true}, true},
+		} {
+			d, err := connecttestftp(t, s, tc.c)
+			if (err == nil) != tc.ok {
+				t.Errorf("implicit %v, CACert %q, InsecureSkipVerify %v: connect error %v", implicit, filepath.Base(tc.c.CACert), tc.c.InsecureSkipVerify, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			// data connections use TLS too
+			if err = d.Store("uplood-john", "a.txt", strings.NewReader("hello"), 5); err != nil {
+				t.Errorf("implicit %v: %v", implicit, err)
+			}
+		}
+	}
+}
+
+func testftpactive(t *testing.T, s *testftpserver) {
+	s.deny["no.txt"] = true
+	s.deny["nodir"] = true
+	d := newtestftpdest(t, s)
+	for _, content := range []string{"hello", ""} {
+		fn := fmt.Sprintf("f%d.txt", len(content))
+		if err := d.Store("uplood-john", fn, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(fn, err)
+		}
+		if b, ok := s.file(fn); !ok || string(b) != content {
+			t.Errorf("%s stored as %q, %v", fn, b, ok)
+		}
+	}
+	size, _, err := d.Check("uplood-john", "f5.txt")
+	if err != nil || size != 5 {
+		t.Errorf("Check = %d, %v", size, err)
+	}
+	// the connection is still usable after a refused upload
+	if err = d.Store("uplood-john", "no.txt", strings.NewReader("x"), 1); !d.Permanent(err) {
+		t.Error("refused upload: want permanent error, got", err)
+	}
+	// other failures are not the fault of the file
+	if err = d.Store("nodir", "f.txt", strings.NewReader("x"), 1); err == nil || d.Permanent(err) {
+		t.Error("CWD failed: want transient error, got", err)
+	}
+	if err = d.Store("uplood-john", "yes.txt", io.LimitReader(strings.NewReader("abc"), 3), 3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFTPCheckSum(t *testing.T) {
+	const hello = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	for _, tc := range []struct {
+		feat []string
+		sum  string
+	}{
+		{nil, ""},
+		{[]string{"MDTM", "HASH SHA-1*;SHA-256;MD5"}, hello},
+		{[]string{"HASH SHA-1*;MD5"}, ""},
+		{[]string{"XSHA256", "SIZE"}, hello},
+	} {
+		s := newtestftpserver(t)
+		s.feat = tc.feat
+		d := newtestftpdest(t, s)
+		if err := d.Store("uplood-john", "hello.txt", strings.NewReader("hello"), 5); err != nil {
+			t.Fatal(err)
+		}
+		size, sum, err := d.Check("uplood-john", "hello.txt")
+		if err != nil || size != 5 || sum != tc.sum {
+			t.Errorf("FEAT %v: Check = %d, %q, %v, want 5, %q", tc.feat, size, sum, err, tc.sum)
+		}
+	}
+}
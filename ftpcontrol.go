@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpcontrol is the control connection of an FTP destination, given
+// to the client library in place of the network connection. It reads
+// the replies of the server itself, so commands the library doesn't
+// have can be sent between those of the library. In active mode, it
+// replaces the EPSV and PASV commands of the library by PORT or EPRT.
+type ftpcontrol struct {
+	net.Conn
+	r       *bufio.Reader
+	tp      *textproto.Reader
+	pending bytes.Buffer // replies for the library, read before r
+	active  bool
+	ln      *net.TCPListener // listener of the next data connection in active mode
+	prelim  bool             // 1xx reply seen since the last PORT or EPRT
+	last    string           // last command of the library
+	midline bool             // a command is being written
+}
+
+func newftpcontrol(conn net.Conn, active bool) *ftpcontrol {
+	c := &ftpcontrol{Conn: conn, active: active}
+	c.r = bufio.NewReader(conn)
+	c.tp = textproto.NewReader(c.r)
+	return c
+}
+
+func (c *ftpcontrol) Read(p []byte) (int, error) {
+	if c.pending.Len() == 0 {
+		line, err := c.r.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		if len(line) > 4 && line[0] == '1' && line[3] == ' ' {
+			c.prelim = true
+		}
+		c.pending.WriteString(line)
+	}
+	return c.pending.Read(p)
+}
+
+func (c *ftpcontrol) Write(p []byte) (int, error) {
+	if !c.midline {
+		if f := strings.Fields(string(p)); len(f) != 0 {
+			c.last = strings.ToUpper(f[0])
+		}
+	}
+	c.midline = !bytes.HasSuffix(p, []byte("\n"))
+	if c.active && !c.midline && (c.last == "EPSV" || c.last == "PASV") {
+		if err := c.port(c.last); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// Close closes the connection, and the listener of
+// a data connection not used yet.
+func (c *ftpcontrol) Close() error {
+	if c.ln != nil {
+		c.ln.Close()
+		c.ln = nil
+	}
+	return c.Conn.Close()
+}
+
+// cmd sends a command of our own, and returns the reply.
+func (c *ftpcontrol) cmd(format string, args ...interface{}) (int, string, error) {
+	if _, err := fmt.Fprintf(c.Conn, format+"\r\n", args...); err != nil {
+		return 0, "", err
+	}
+	return c.tp.ReadResponse(0)
+}
+
+// reply passes a reply to the client library.
+func (c *ftpcontrol) reply(code int, msg string) {
+	fmt.Fprintf(&c.pending, "%d %s\r\n", code, strings.Replace(msg, "\n", " ", -1))
+}
+
+// authtls reads the greeting of the server and upgrades the connection
+// using AUTH TLS. The greeting is passed to the client library afterwards.
+func (c *ftpcontrol) authtls(cfg *tls.Config) error {
+	code, msg, err := c.tp.ReadResponse(ftp.StatusReady)
+	if err != nil {
+		return err
+	}
+	acode, amsg, err := c.cmd("AUTH TLS")
+	if err != nil {
+		return err
+	}
+	if acode != ftp.StatusAuthOK {
+		return &textproto.Error{Code: acode, Msg: amsg}
+	}
+	c.Conn = tls.Client(c.Conn, cfg)
+	c.r.Reset(c.Conn)
+	c.reply(code, msg)
+	return nil
+}
+
+// port listens for the next data connection, and sends its address to
+// the server with PORT, or EPRT for IPv6. The reply to the passive mode
+// command verb of the library pretends the server to listen on the port.
+func (c *ftpcontrol) port(verb string) error {
+	if c.ln != nil {
+		c.ln.Close()
+		c.ln = nil
+	}
+	local, ok := c.Conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("active mode needs a TCP connection")
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	var code int
+	var msg string
+	if ip := local.IP.To4(); ip != nil {
+		code, msg, err = c.cmd("PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	} else {
+		code, msg, err = c.cmd("EPRT |2|%s|%d|", local.IP, port)
+	}
+	if err != nil || code != ftp.StatusCommandOK {
+		ln.Close()
+		if err == nil {
+			// the library fails with the reply
+			c.reply(code, msg)
+		}
+		return err
+	}
+	c.ln, c.prelim = ln, false
+	if verb == "EPSV" {
+		c.reply(ftp.StatusExtendedPassiveMode, "Entering Extended Passive Mode (|||"+strconv.Itoa(port)+"|)")
+	} else {
+		c.reply(ftp.StatusPassiveMode, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff))
+	}
+	return nil
+}
+
+// activeconn is a data connection in active mode. The client library
+// opens it before sending the command making the server connect, so
+// it is accepted when first used. Deadlines set before are ignored.
+type activeconn struct {
+	ctl     *ftpcontrol
+	ln      *net.TCPListener
+	timeout time.Duration // for the server to connect
+	wrap    func(net.Conn) net.Conn
+	conn    net.Conn
+	err     error
+}
+
+// dataconn returns the data connection for the listener
+// set up by the last PORT or EPRT.
+func (c *ftpcontrol) dataconn(timeout time.Duration, wrap func(net.Conn) net.Conn) net.Conn {
+	conn := &activeconn{ctl: c, ln: c.ln, timeout: timeout, wrap: wrap}
+	c.ln = nil
+	return conn
+}
+
+func (c *activeconn) accept() error {
+	if c.conn == nil && c.err == nil {
+		c.ln.SetDeadline(time.Now().Add(c.timeout))
+		conn, err := c.ln.Accept()
+		c.ln.Close()
+		if err != nil {
+			c.err = fmt.Errorf("active mode: %v", err)
+		} else {
+			c.conn = c.wrap(conn)
+		}
+	}
+	return c.err
+}
+
+func (c *activeconn) Read(p []byte) (int, error) {
+	if err := c.accept(); err != nil {
+		return 0, err
+	}
+	return c.conn.Read(p)
+}
+
+func (c *activeconn) Write(p []byte) (int, error) {
+	if err := c.accept(); err != nil {
+		return 0, err
+	}
+	return c.conn.Write(p)
+}
+
+// Handshake accepts the connection, and does the TLS handshake if
+// used. The client library calls it for empty files.
+func (c *activeconn) Handshake() error {
+	if err := c.accept(); err != nil {
+		return err
+	}
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		return tc.Handshake()
+	}
+	return nil
+}
+
+func (c *activeconn) Close() error {
+	if c.conn == nil && c.err == nil {
+		if !c.ctl.prelim {
+			// the server refused the command, it won't connect
+			c.err = net.ErrClosed
+			return c.ln.Close()
+		}
+		// the server connects even if nothing is sent
+		c.accept()
+	}
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *activeconn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	}
+	return c.ln.Addr()
+}
+
+func (c *activeconn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *activeconn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *activeconn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *activeconn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	HOOK_COMMAND_TIMEOUT = 10 * time.Minute
+	HOOK_WEBHOOK_TIMEOUT = 30 * time.Second
+	HOOK_RETRY_DELAY     = 10 * time.Second
+	HOOK_RETRY_MAX       = 6 // webhook attempts
+)
+
+// DeliveryEvent describes a file delivered to a destination.
+type DeliveryEvent struct {
+	Event      string    `json:"event"` // always "delivered"
+	Dest       string    `json:"dest"`
+	User       string    `json:"user"`
+	Filename   string    `json:"filename"`         // original filename
+	RemotePath string    `json:"remote_path"`      // relative to the remote directory
+	Size       int64     `json:"size"`             // of the remote file
+	SHA256     string    `json:"sha256,omitempty"` // of the remote file
+	Time       time.Time `json:"time"`
+
+	// the uploaded content, if encrypted for the destination
+	OriginalSize   int64  `json:"original_size,omitempty"`
+	OriginalSHA256 string `json:"original_sha256,omitempty"`
+}
+
+// hooks run after each file is delivered to a destination.
+type hooks struct {
+	command []string
+	webhook string
+	client  *http.Client
+	log     *log.Logger
+}
+
+func newhooks(c DestConfig, l *log.Logger) (*hooks, error) {
+	h := &hooks{command: c.HookCommand, webhook: c.Webhook, log: l}
+	if len(h.command) != 0 {
+		if _, err := exec.LookPath(h.command[0]); err != nil {
+			return nil, fmt.Errorf("invalid hook command: %v", err)
+		}
+	}
+	if h.webhook != "" {
+		u, err := url.Parse(h.webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL: %s", h.webhook)
+		}
+		h.client = &http.Client{Timeout: HOOK_WEBHOOK_TIMEOUT}
+	}
+	return h, nil
+}
+
+// delivered runs the hooks for f stored at remotepath in the
+// background. Enc is the encrypted copy stored, nil if f is stored
+// as is.
+func (h *hooks) delivered(dest string, f CachedFile, remotepath string, enc *encryptedcopy) {
+	if len(h.command) == 0 && h.webhook == "" {
+		return
+	}
+	ev := &DeliveryEvent{
+		Event:      "delivered",
+		Dest:       dest,
+		User:       f.User(),
+		Filename:   f.Filename(),
+		RemotePath: remotepath,
+		Size:       f.Size(),
+		SHA256:     f.Sum(),
+		Time:       time.Now(),
+	}
+	if enc != nil {
+		ev.Size, ev.SHA256 = enc.size, enc.sum
+		ev.OriginalSize, ev.OriginalSHA256 = f.Size(), f.Sum()
+	}
+	if len(h.command) != 0 {
+		go h.runcommand(ev)
+	}
+	if h.webhook != "" {
+		go h.post(ev)
+	}
+}
+
+// runcommand runs the hook command with the event in the environment.
+func (h *hooks) runcommand(ev *DeliveryEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), HOOK_COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"UPLOAD_DEST="+ev.Dest,
+		"UPLOAD_USER="+ev.User,
+		"UPLOAD_FILENAME="+ev.Filename,
+		"UPLOAD_REMOTE_PATH="+ev.RemotePath,
+		fmt.Sprint("UPLOAD_SIZE=", ev.Size),
+		"UPLOAD_SHA256="+ev.SHA256,
+	)
+	if ev.OriginalSHA256 != "" {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprint("UPLOAD_ORIGINAL_SIZE=", ev.OriginalSize),
+			"UPLOAD_ORIGINAL_SHA256="+ev.OriginalSHA256,
+		)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		h.log.Println("Hook command for", ev.RemotePath, "failed:", err, strings.TrimSpace(string(out)))
+		return
+	}
+	h.log.Println("Hook command for", ev.RemotePath, "done")
+}
+
+// post sends the event to the webhook, retrying with
+// increasing delays if it fails.
+func (h *hooks) post(ev *DeliveryEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		h.log.Println("Webhook for", ev.RemotePath, "failed:", err)
+		return
+	}
+	delay := HOOK_RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		retry, err := h.postonce(body)
+		if err == nil {
+			h.log.Println("Webhook for", ev.RemotePath, "done")
+			return
+		}
+		if !retry || attempt == HOOK_RETRY_MAX {
+			h.log.Println("Webhook for", ev.RemotePath, "failed, giving up:", err)
+			return
+		}
+		h.log.Println("Webhook for", ev.RemotePath, "failed, retry in", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postonce posts body to the webhook, and reports
+// if the request should be retried on failure.
+func (h *hooks) postonce(body []byte) (retry bool, err error) {
+	resp, err := h.client.Post(h.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("%s", resp.Status)
+	}
+	return false, fmt.Errorf("%s", resp.Status)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveryEvent(t *testing.T) {
+	ch := make(chan *DeliveryEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := new(DeliveryEvent)
+		if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
+			t.Error(err)
+		}
+		ch <- ev
+	}))
+	defer ts.Close()
+	h, err := newhooks(DestConfig{Webhook: ts.URL}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newtestcache(t).Add("John", "a.txt", "en", "127.0.0.1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		enc            *encryptedcopy
+		size, origsize int64
+		sum, origsum   string
+	}{
+		{nil, 5, 0, f.Sum(), ""},
+		{&encryptedcopy{size: 230, sum: "9f86d0"}, 230, 5, "9f86d0", f.Sum()},
+	} {
+		h.delivered("file:///tmp", f, "uplood-john/a.txt", tc.enc)
+		select {
+		case ev := <-ch:
+			if ev.Size != tc.size || ev.SHA256 != tc.sum || ev.OriginalSize != tc.origsize || ev.OriginalSHA256 != tc.origsum {
+				t.Errorf("event %+v, want size %d %s, original %d %s", ev, tc.size, tc.sum, tc.origsize, tc.origsum)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook call")
+		}
+	}
+}
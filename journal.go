@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// compact the journal when it has this many records,
+// and more than twice the number of live keys
+const JOURNAL_COMPACT_MIN = 1000
+
+// journal is a key/value store kept in an append-only file. Each
+// update is appended as a line of JSON and synced to disk, so it is
+// durable once put or delete returns. The file is rewritten with
+// only the live values when it grows too large.
+type journal struct {
+	name string
+	log  *log.Logger
+	mtx  sync.Mutex
+	f    *os.File
+	size int64                      // end of the last record in f
+	keys []string                   // keys in order of insertion
+	vals map[string]json.RawMessage // live values
+	nrec int                        // records in the file
+}
+
+type journalrecord struct {
+	K string          `json:"k"`
+	V json.RawMessage `json:"v,omitempty"`
+	D bool            `json:"d,omitempty"` // key deleted
+}
+
+// openjournal opens or creates the journal file name, and reads its
+// content. An incomplete record at the end of the file, left by a
+// crash during a write, is discarded. Other invalid records are
+// skipped.
+func openjournal(name string, l *log.Logger) (*journal, error) {
+	j := &journal{name: name, log: l, vals: make(map[string]json.RawMessage)}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var good int64 // end of the last complete record
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			j.log.Println("Discarding incomplete journal record at", good, "in", name)
+			if err = f.Truncate(good); err != nil {
+				f.Close()
+				return nil, err
+			}
+			break
+		}
+		var rec journalrecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			// kept in the file until the next compaction
+			j.log.Println("Skipping invalid journal record at", good, "in", name+":", err)
+			j.nrec++
+		} else {
+			j.apply(&rec)
+		}
+		good += int64(len(line))
+	}
+	if _, err = f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f, j.size = f, good
+	if j.needcompact() {
+		if err = j.compact(); err != nil {
+			j.log.Println("Can't compact journal:", err)
+		}
+	}
+	return j, nil
+}
+
+// apply updates the values with rec.
+func (j *journal) apply(rec *journalrecord) {
+	j.nrec++
+	_, ok := j.vals[rec.K]
+	if rec.D {
+		if ok {
+			delete(j.vals, rec.K)
+			for i, k := range j.keys {
+				if k == rec.K {
+					j.keys = append(j.keys[:i], j.keys[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	if !ok {
+		j.keys = append(j.keys, rec.K)
+	}
+	j.vals[rec.K] = rec.V
+}
+
+// each calls fn with the live values in order of insertion.
+func (j *journal) each(fn func(key string, val json.RawMessage)) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for _, k := range j.keys {
+		fn(k, j.vals[k])
+	}
+}
+
+// len returns the number of live keys.
+func (j *journal) len() int {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return len(j.keys)
+}
+
+// put sets the value of key to v encoded as JSON.
+func (j *journal) put(key string, v interface{}) error {
+	var b journalbatch
+	if err := b.put(key, v); err != nil {
+		return err
+	}
+	return j.commit(b)
+}
+
+// delete removes key.
+func (j *journal) delete(key string) error {
+	var b journalbatch
+	b.delete(key)
+	return j.commit(b)
+}
+
+// journalbatch is a list of updates written at once by commit.
+type journalbatch []*journalrecord
+
+// put sets the value of key to v encoded as JSON.
+func (b *journalbatch) put(key string, v interface{}) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	*b = append(*b, &journalrecord{K: key, V: p})
+	return nil
+}
+
+// delete removes key.
+func (b *journalbatch) delete(key string) {
+	*b = append(*b, &journalrecord{K: key, D: true})
+}
+
+// commit appends the updates of b to the file, with a single sync.
+// Deletes of keys without a value are not recorded.
+func (j *journal) commit(b journalbatch) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	var buf bytes.Buffer
+	var recs []*journalrecord
+	set := make(map[string]bool) // keys put earlier in b
+	for _, rec := range b {
+		if _, ok := j.vals[rec.K]; rec.D && !ok && !set[rec.K] {
+			continue
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		recs = append(recs, rec)
+		set[rec.K] = !rec.D
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	_, err := j.f.Write(buf.Bytes())
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		// don't leave a partial record before the next one
+		if j.f.Truncate(j.size) == nil {
+			j.f.Seek(j.size, io.SeekStart)
+		}
+		return err
+	}
+	j.size += int64(buf.Len())
+	for _, rec := range recs {
+		j.apply(rec)
+	}
+	if j.needcompact() {
+		if errc := j.compact(); errc != nil {
+			j.log.Println("Can't compact journal:", errc)
+		}
+	}
+	return nil
+}
+
+func (j *journal) needcompact() bool {
+	return j.nrec >= JOURNAL_COMPACT_MIN && j.nrec > 2*len(j.keys)
+}
+
+// compact rewrites the file with the live values. The new file
+// replaces the old one once it is complete and synced.
+// Must be called with j.mtx held.
+func (j *journal) compact() error {
+	var buf bytes.Buffer
+	for _, k := range j.keys {
+		line, err := json.Marshal(&journalrecord{K: k, V: j.vals[k]})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := j.name + tmp_suffix
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// the old file must be closed to be replaced on windows
+	j.f.Close()
+	if err = os.Rename(tmp, j.name); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		// keep appending to the old file
+		if f, errf := os.OpenFile(j.name, os.O_RDWR, 0600); errf == nil {
+			f.Seek(j.size, io.SeekStart)
+			j.f = f
+		}
+		return err
+	}
+	j.f, j.size, j.nrec = f, int64(buf.Len()), len(j.keys)
+	// the rename is durable only once the directory is synced
+	if err = syncdir(filepath.Dir(j.name)); err != nil {
+		j.log.Println("Can't sync journal directory:", err)
+	}
+	return nil
+}
+
+// close compacts and closes the journal.
+func (j *journal) close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.nrec > len(j.keys) {
+		if err := j.compact(); err != nil {
+			j.log.Println("Can't compact journal:", err)
+		}
+	}
+	return j.f.Close()
+}
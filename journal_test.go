@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func opentestjournal(t *testing.T, name string) *journal {
+	j, err := openjournal(name, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// journalvalues returns the live values of j as key=value.
+func journalvalues(j *journal) string {
+	var v []string
+	j.each(func(key string, val json.RawMessage) {
+		v = append(v, key+"="+string(val))
+	})
+	return strings.Join(v, " ")
+}
+
+func TestJournalIncompleteRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.journal")
+	j := opentestjournal(t, name)
+	j.put("a", 1)
+	j.put("b", 2)
+	j.close()
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"k":"c","v":`)
+	f.Close()
+
+	j = opentestjournal(t, name)
+	if v := journalvalues(j); v != "a=1 b=2" {
+		t.Errorf("values after crash: %s", v)
+	}
+	if fi2, err := os.Stat(name); err != nil || fi2.Size() != fi.Size() {
+		t.Errorf("incomplete record not truncated: size %d, want %d", fi2.Size(), fi.Size())
+	}
+	// the next record follows the last complete one
+	if err = j.put("c", 3); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	j = opentestjournal(t, name)
+	defer j.close()
+	if v := journalvalues(j); v != "a=1 b=2 c=3" {
+		t.Errorf("values after reopen: %s", v)
+	}
+}
+
+func TestJournalInvalidRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.journal")
+	j := opentestjournal(t, name)
+	j.put("a", 1)
+	j.close()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{garbage\n")
+	f.Close()
+	j = opentestjournal(t, name)
+	j.put("b", 2)
+	j.close()
+
+	// the records after the invalid one are kept
+	j = opentestjournal(t, name)
+	defer j.close()
+	if v := journalvalues(j); v != "a=1 b=2" {
+		t.Errorf("values %s, want a=1 b=2", v)
+	}
+	// and the invalid one is dropped by compaction
+	if b, err := ioutil.ReadFile(name); err != nil || strings.Contains(string(b), "garbage") {
+		t.Errorf("journal %q, %v", b, err)
+	}
+}
+
+func TestJournalBatch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.journal")
+	j := opentestjournal(t, name)
+	defer j.close()
+	j.put("a", 1)
+	var b journalbatch
+	b.delete("a")
+	b.delete("unknown") // not recorded
+	b.put("c", 3)
+	b.delete("c")
+	b.put("c", 4)
+	if err := j.commit(b); err != nil {
+		t.Fatal(err)
+	}
+	if v := journalvalues(j); v != "c=4" || j.nrec != 5 {
+		t.Errorf("values %s in %d records, want c=4 in 5", v, j.nrec)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.journal")
+	j := opentestjournal(t, name)
+	const n, del = JOURNAL_COMPACT_MIN * 3 / 5, JOURNAL_COMPACT_MIN * 2 / 5
+	j.delete("unknown") // not recorded
+	for i := 0; i < n; i++ {
+		j.put(fmt.Sprint(i), i)
+	}
+	// the last delete makes JOURNAL_COMPACT_MIN records
+	for i := 0; i < del; i++ {
+		j.delete(fmt.Sprint(i))
+	}
+	if j.nrec != n-del {
+		t.Errorf("%d records after compaction, want %d", j.nrec, n-del)
+	}
+	fi, err := os.Stat(name)
+	if err != nil || fi.Size() != j.size {
+		t.Errorf("file has %d bytes, want %d", fi.Size(), j.size)
+	}
+	// deleted keys can be set again
+	j.put("0", "x")
+	j.delete(fmt.Sprint(del))
+	want := journalvalues(j)
+	if !strings.HasPrefix(want, fmt.Sprintf("%d=%d ", del+1, del+1)) || !strings.HasSuffix(want, ` 0="x"`) {
+		t.Errorf("values %.20s...%s", want, want[len(want)-20:])
+	}
+	j.close()
+	if _, err = os.Stat(name + tmp_suffix); !os.IsNotExist(err) {
+		t.Error("temporary file left:", err)
+	}
+	j = opentestjournal(t, name)
+	defer j.close()
+	if v := journalvalues(j); v != want {
+		t.Error("values changed by reopening")
+	}
+	if j.nrec != j.len() {
+		t.Errorf("%d records after close, want %d", j.nrec, j.len())
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_LAYOUT      = USER_DIR_PREFIX + "{user_ascii}"
+	DEFAULT_DATE_FORMAT = "2006-01-02"
+)
+
+// layout is a template for the remote directory of uploaded files,
+// eg. "photos/{user_ascii}/{date:2006-01}". Placeholders are:
+//
+//	{user}        name of the user, lowercase
+//	{user_ascii}  name of the user, lowercase punycode
+//	{date}        upload date, an optional Go time format may follow a colon
+//	{lang}        language of the page used for the upload, letters only
+//	{ext}         extension of the file without the dot, lowercase
+//	              letters and digits only
+//
+// Empty values are replaced by "_". The layout must contain the user,
+// so the remote directories can be mapped back to users. The user must
+// be separated from other placeholders by some text, so it can be told
+// apart from them.
+type layout struct {
+	elems  [][]layoutpart   // parts of each path element
+	match  []*regexp.Regexp // patterns matching path elements
+	userel int              // element containing the user
+	ascii  bool             // user is in punycode
+}
+
+// layoutpart is literal text or a placeholder.
+type layoutpart struct {
+	text string // literal text, or the name of the placeholder
+	arg  string // time format for date
+	ph   bool
+}
+
+func newlayout(tmpl string) (*layout, error) {
+	if tmpl == "" {
+		tmpl = DEFAULT_LAYOUT
+	}
+	l := &layout{userel: -1}
+	for i, el := range strings.Split(strings.Trim(tmpl, "/"), "/") {
+		if el == "" || el == "." || el == ".." {
+			return nil, fmt.Errorf("invalid element %q in layout %s", el, tmpl)
+		}
+		parts, err := parselayoutelem(el)
+		if err != nil {
+			return nil, fmt.Errorf("layout %s: %v", tmpl, err)
+		}
+		re := "^"
+		for j, p := range parts {
+			switch {
+			case !p.ph:
+				re += regexp.QuoteMeta(p.text)
+			case p.isuser() && l.userel == -1:
+				if j > 0 && parts[j-1].ph || j+1 < len(parts) && parts[j+1].ph {
+					return nil, fmt.Errorf("layout %s: {%s} must be separated from other placeholders", tmpl, p.text)
+				}
+				l.userel, l.ascii = i, p.text == "user_ascii"
+				re += "(.+?)"
+			case p.isuser() && l.userel == i:
+				return nil, fmt.Errorf("layout %s: more than one user in %s", tmpl, el)
+			default:
+				re += p.pattern()
+			}
+		}
+		l.elems = append(l.elems, parts)
+		l.match = append(l.match, regexp.MustCompile(re+"$"))
+	}
+	if l.userel == -1 {
+		return nil, fmt.Errorf("layout %s has no {user} or {user_ascii}", tmpl)
+	}
+	return l, nil
+}
+
+func parselayoutelem(el string) ([]layoutpart, error) {
+	var parts []layoutpart
+	for el != "" {
+		i := strings.IndexByte(el, '{')
+		if i == -1 {
+			parts = append(parts, layoutpart{text: el})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, layoutpart{text: el[:i]})
+		}
+		j := strings.IndexByte(el, '}')
+		if j < i {
+			return nil, fmt.Errorf("unterminated placeholder in %s", el)
+		}
+		p := layoutpart{text: el[i+1 : j], ph: true}
+		if k := strings.IndexByte(p.text, ':'); k != -1 {
+			p.text, p.arg = p.text[:k], p.text[k+1:]
+		}
+		switch p.text {
+		case "date":
+			if p.arg == "" {
+				p.arg = DEFAULT_DATE_FORMAT
+			}
+			if err := checkdateformat(p.arg); err != nil {
+				return nil, err
+			}
+		case "user", "user_ascii", "lang", "ext":
+			if p.arg != "" {
+				return nil, fmt.Errorf("placeholder {%s} has no format", p.text)
+			}
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%s}", p.text)
+		}
+		parts = append(parts, p)
+		el = el[j+1:]
+	}
+	return parts, nil
+}
+
+func (p layoutpart) isuser() bool {
+	return p.ph && (p.text == "user" || p.text == "user_ascii")
+}
+
+// pattern returns a regular expression matching the
+// values of the placeholder p, other than the user.
+func (p layoutpart) pattern() string {
+	switch p.text {
+	case "date":
+		return datepattern(p.arg)
+	case "lang":
+		return "(?:[a-z]+|_)"
+	case "ext":
+		return "(?:[a-z0-9]+|_)"
+	}
+	return ".+?"
+}
+
+// datetokens are the elements of Go time formats, longest first
+// where one is the prefix of another, with regular expressions
+// matching their values.
+var datetokens = []struct{ tok, re string }{
+	{"January", "[A-Za-z]+"},
+	{"Jan", "[A-Za-z]{3}"},
+	{"Monday", "[A-Za-z]+"},
+	{"Mon", "[A-Za-z]{3}"},
+	{"MST", `(?:[A-Za-z]+|[-+]\d{2,4})`},
+	{"2006", `\d{4}`},
+	{"_2006", `_\d{4}`},
+	{"__2", `[ \d]{2}\d`},
+	{"_2", `[ \d]\d`},
+	{"002", `\d{3}`},
+	{"01", `\d{2}`},
+	{"02", `\d{2}`},
+	{"03", `\d{2}`},
+	{"04", `\d{2}`},
+	{"05", `\d{2}`},
+	{"06", `\d{2}`},
+	{"15", `\d{2}`},
+	{"1", `\d{1,2}`},
+	{"2", `\d{1,2}`},
+	{"3", `\d{1,2}`},
+	{"4", `\d{1,2}`},
+	{"5", `\d{1,2}`},
+	{"PM", "[AP]M"},
+	{"pm", "[ap]m"},
+	{"Z07:00:00", `(?:Z|[-+]\d{2}:\d{2}:\d{2})`},
+	{"Z070000", `(?:Z|[-+]\d{6})`},
+	{"Z07:00", `(?:Z|[-+]\d{2}:\d{2})`},
+	{"Z0700", `(?:Z|[-+]\d{4})`},
+	{"Z07", `(?:Z|[-+]\d{2})`},
+	{"-07:00:00", `[-+]\d{2}:\d{2}:\d{2}`},
+	{"-070000", `[-+]\d{6}`},
+	{"-07:00", `[-+]\d{2}:\d{2}`},
+	{"-0700", `[-+]\d{4}`},
+	{"-07", `[-+]\d{2}`},
+}
+
+// datepattern returns a regular expression matching
+// the dates formatted with the Go time format f.
+func datepattern(f string) string {
+	re := ""
+next:
+	for f != "" {
+		if c := f[0]; c == '.' || c == ',' {
+			// fractional seconds, if not followed by a digit
+			n := 1
+			for n < len(f) && f[n] == f[1] && (f[1] == '0' || f[1] == '9') {
+				n++
+			}
+			if n > 1 && (n == len(f) || f[n] < '0' || f[n] > '9') {
+				if f[1] == '0' {
+					re += fmt.Sprintf(`[.,]\d{%d}`, n-1)
+				} else {
+					re += `(?:[.,]\d+)?`
+				}
+				f = f[n:]
+				continue
+			}
+		}
+		for _, t := range datetokens {
+			if strings.HasPrefix(f, t.tok) {
+				re += t.re
+				f = f[len(t.tok):]
+				continue next
+			}
+		}
+		_, n := utf8.DecodeRuneInString(f)
+		re += regexp.QuoteMeta(layoutvalue(f[:n]))
+		f = f[n:]
+	}
+	return re
+}
+
+// checkdateformat returns an error if the directories made
+// using the date format f can't be recognized.
+func checkdateformat(f string) error {
+	re := regexp.MustCompile("^" + datepattern(f) + "$")
+	for _, t := range []time.Time{
+		time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		time.Date(2014, 12, 31, 9, 59, 9, 123456789, time.FixedZone("CEST", 2*3600)),
+		time.Date(2020, 6, 7, 0, 0, 0, 0, time.FixedZone("", -3*3600-30*60)),
+	} {
+		if v := layoutvalue(t.Format(f)); !re.MatchString(v) {
+			return fmt.Errorf("unsupported date format %s", f)
+		}
+	}
+	return nil
+}
+
+// check returns an error if files of user can't be stored using the layout.
+func (l *layout) check(user string) error {
+	if user == "." || user == ".." || strings.ContainsAny(user, `/\`) {
+		return fmt.Errorf("user name %s can't be used as directory", user)
+	}
+	return nil
+}
+
+// expand returns the remote directory of f.
+func (l *layout) expand(f CachedFile) (string, error) {
+	t := f.Time()
+	if t.IsZero() {
+		t = time.Now()
+	}
+	elems := make([]string, len(l.elems))
+	for i, parts := range l.elems {
+		el := ""
+		for _, p := range parts {
+			if !p.ph {
+				el += p.text
+				continue
+			}
+			var v string
+			switch p.text {
+			case "user":
+				v = strings.ToLower(f.User())
+			case "user_ascii":
+				var err error
+				if v, err = Encodename(f.User()); err != nil {
+					return "", err
+				}
+			case "date":
+				v = t.Format(p.arg)
+			case "lang":
+				v = onlychars(strings.ToLower(f.Lang()), "abcdefghijklmnopqrstuvwxyz")
+			case "ext":
+				v = strings.ToLower(strings.TrimPrefix(path.Ext(f.Filename()), "."))
+				v = onlychars(v, "abcdefghijklmnopqrstuvwxyz0123456789")
+			}
+			el += layoutvalue(v)
+		}
+		elems[i] = el
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// layoutvalue returns the value v of a placeholder
+// as used in the name of a directory.
+func layoutvalue(v string) string {
+	v = strings.NewReplacer("/", "_", `\`, "_").Replace(v)
+	if v == "" {
+		v = "_"
+	}
+	return v
+}
+
+// onlychars returns s without the characters not in chars.
+func onlychars(s, chars string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(chars, r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// depth returns the number of path elements of the remote directories.
+func (l *layout) depth() int {
+	return len(l.elems)
+}
+
+// matchelem reports if name matches the path element i of the layout,
+// and returns the user for the element containing it.
+func (l *layout) matchelem(i int, name string) (user string, ok bool, err error) {
+	m := l.match[i].FindStringSubmatch(name)
+	if m == nil {
+		return "", false, nil
+	}
+	if i != l.userel {
+		return "", true, nil
+	}
+	user = m[1]
+	if l.ascii {
+		user, err = Decodename(user)
+	}
+	return user, true, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayoutRoundTrip(t *testing.T) {
+	tm := time.Date(2014, 6, 12, 15, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		layout, user, fn, lang string
+		dir                    string
+	}{
+		{"", "John", "a.jpg", "en", "uplood-john"},
+		{"{user_ascii}-{date:2006-01}", "john-doe", "a.jpg", "en", "john-doe-2014-06"},
+		{"{user_ascii}-{date:2006-01}", "john-2014-06", "a.jpg", "en", "john-2014-06-2014-06"},
+		{"{user}_{lang}", "anna_de", "a.jpg", "en", "anna_de_en"},
+		{"{user}-{ext}", "a-b", "IMG.MP4", "de", "a-b-mp4"},
+		{"{user}-{ext}", "a-b", "README", "de", "a-b-_"},
+		{"{user}.{date:Jan 2}", "x", "a", "hu", "x.Jun 12"},
+		{"{user_ascii}/{date:2006-01}/{ext}", "Jürgen", "a.tar.gz", "de", "xn--jrgen-kva/2014-06/gz"},
+		{"{date:2006}/x{user}x", "xx", "a", "en", "2014/xxxx"},
+	} {
+		l, err := newlayout(tc.layout)
+		if err != nil {
+			t.Errorf("%s: %v", tc.layout, err)
+			continue
+		}
+		dir, err := l.expand(&CacheEntry{Un: tc.user, Fn: tc.fn, Ln: tc.lang, Tm: tm})
+		if err != nil || dir != tc.dir {
+			t.Errorf("%s: expand = %q, %v, want %q", tc.layout, dir, err, tc.dir)
+			continue
+		}
+		user := ""
+		for i, el := range strings.Split(dir, "/") {
+			u, ok, err := l.matchelem(i, el)
+			if !ok || err != nil {
+				t.Errorf("%s: element %q doesn't match: %v", tc.layout, el, err)
+			}
+			if u != "" {
+				user = u
+			}
+		}
+		if user != strings.ToLower(tc.user) {
+			t.Errorf("%s: %s is of user %q, want %q", tc.layout, dir, user, strings.ToLower(tc.user))
+		}
+	}
+}
+
+func TestLayoutMatchElem(t *testing.T) {
+	l, err := newlayout("{user}-{date:2006-01}/{lang}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		i    int
+		name string
+		user string
+		ok   bool
+	}{
+		{0, "john-2014-06", "john", true},
+		{0, "john-doe-2014-06", "john-doe", true},
+		{0, "john-2014-6", "", false},
+		{0, "john", "", false},
+		{0, "-2014-06", "", false},
+		{1, "en", "", true},
+		{1, "_", "", true},
+		{1, "en-US", "", false},
+	} {
+		user, ok, err := l.matchelem(tc.i, tc.name)
+		if user != tc.user || ok != tc.ok || err != nil {
+			t.Errorf("matchelem(%d, %q) = %q, %v, %v, want %q, %v", tc.i, tc.name, user, ok, err, tc.user, tc.ok)
+		}
+	}
+}
+
+func TestLayoutInvalid(t *testing.T) {
+	for _, layout := range []string{
+		"photos",
+		"{user}/../x",
+		"{user}{ext}",
+		"{date}{user_ascii}",
+		"{user}-{user_ascii}",
+		"{user}-{size}",
+		"{user}-{ext:x}",
+		"{user",
+	} {
+		if _, err := newlayout(layout); err == nil {
+			t.Errorf("%s: no error", layout)
+		}
+	}
+}
+
+func TestDatePattern(t *testing.T) {
+	for _, f := range []string{
+		"2006-01-02", "2006-01", "Jan 2006", "January", "Mon _2", "15.04.05.000",
+		"2006.01.02", "3:04PM", "Z07:00", "-0700 MST", "__2", "_2006", "2006-002",
+	} {
+		if err := checkdateformat(f); err != nil {
+			t.Error(err)
+		}
+	}
+}
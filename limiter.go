@@ -26,17 +26,23 @@ func (w *LimitWriter) Write(p []byte) (n int, err error) {
 		return 0, fmt.Errorf("write after buffer full/finish")
 	}
 	if w.avail < len(p) {
-		needed := 1024 * 1024
-		if needed < len(p) {
-			needed = len(p)
+		// allocate 1 MiB at once, or only what is missing
+		// if that is more than the limiter permits
+		needed := len(p) - w.avail
+		chunk := 1024 * 1024
+		if chunk < needed {
+			chunk = needed
 		}
-		if w.l.AllocBytes(needed) {
-			w.alloc += needed
-			w.avail += needed
-		} else {
+		switch {
+		case w.l.AllocBytes(chunk):
+			needed = chunk
+		case chunk > needed && w.l.AllocBytes(needed):
+		default:
 			w.avail = -1
 			return 0, fmt.Errorf("buffer full")
 		}
+		w.alloc += needed
+		w.avail += needed
 	}
 	n, err = w.w.Write(p)
 	w.avail -= n
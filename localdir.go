@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// localDestination stores files in a local directory tree.
+type localDestination struct {
+	RemoteDir string
+
+	log       *log.Logger
+	connected bool
+}
+
+func newLocalDestination(u *url.URL, l *log.Logger) (*localDestination, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file:// URL with remote host '%s' not supported", u.Host)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("file:// URL needs a path")
+	}
+	return &localDestination{
+		RemoteDir: filepath.FromSlash(u.Path),
+		log:       l,
+	}, nil
+}
+
+func (d *localDestination) Connect() error {
+	fi, err := os.Stat(d.RemoteDir)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("%s is not a directory", d.RemoteDir)
+	}
+	if err != nil {
+		d.log.Println("Can't access", d.RemoteDir+":", err)
+		return err
+	}
+	d.connected = true
+	return nil
+}
+
+func (d *localDestination) Disconnect() error {
+	d.connected = false
+	return nil
+}
+
+func (d *localDestination) Connected() bool {
+	return d.connected
+}
+
+func (d *localDestination) Store(userdir, filename string, r io.Reader, size int64) (err error) {
+	dir := filepath.Join(d.RemoteDir, userdir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		d.log.Println("Creating directory", dir, "failed:", err)
+		return
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(dir, ".upload-"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = io.Copy(f, r); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, filename))
+}
+
+// Permanent reports if writing the file was not permitted.
+// Failing to create the user directory is retried.
+func (d *localDestination) Permanent(err error) bool {
+	var pe *os.PathError
+	if errors.As(err, &pe) && pe.Op == "mkdir" {
+		return false
+	}
+	return os.IsPermission(err)
+}
+
+func (d *localDestination) Check(userdir, filename string) (size int64, sum string, err error) {
+	f, err := os.Open(filepath.Join(d.RemoteDir, userdir, filename))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err == nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+	return
+}
+
+func (d *localDestination) Fetch(userdir, filename string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.RemoteDir, userdir, filename))
+}
+
+func (d *localDestination) List(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(d.RemoteDir, dir))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 func die(v ...interface{}) {
 	fmt.Fprintln(os.Stderr, v...)
 	os.Exit(1)
@@ -23,6 +31,7 @@ func check(err error) {
 func main() {
 	addr := flag.String("addr", "", `address to listen on, eg. ":8080"`)
 	sock := flag.String("socket", "", `file (unix socket) to listen on`)
+	opaddr := flag.String("opaddr", "", `address to serve the operator pages on, eg. "127.0.0.1:8081"`)
 	prefix := flag.String("prefix", "/web-ftp-upload", `web server path prefix`)
 	wdir := flag.String("share", ".", `directory for data (template and external) files`)
 	cfg := flag.String("config", "config.json", `config file`)
@@ -55,7 +64,42 @@ func main() {
 		die("config.MaxCacheSize:", err)
 	}
 
-	err = inituploader(config.FTPUrl, maxcachesize)
+	shutdowntimeout := SHUTDOWN_TIMEOUT
+	if config.ShutdownTimeout != "" {
+		shutdowntimeout, err = time.ParseDuration(config.ShutdownTimeout)
+		if err != nil || shutdowntimeout < 0 {
+			die("config.ShutdownTimeout: invalid duration", config.ShutdownTimeout)
+		}
+	}
+
+	opt := CacheOptions{
+		Path:    config.CachePath,
+		MaxSize: maxcachesize,
+		Encrypt: config.EncryptCache,
+	}
+	if opt.MinFree, err = parselimit(config.MinFreeSpace); err != nil {
+		die("config.MinFreeSpace:", err)
+	}
+	for _, vc := range config.CacheVolumes {
+		maxsize, err := parselimit(vc.MaxSize)
+		if err != nil {
+			die("config.CacheVolumes:", err)
+		}
+		v, err := newcachevolume(vc.Path, maxsize)
+		if err != nil {
+			die("config.CacheVolumes:", err)
+		}
+		opt.Volumes = append(opt.Volumes, v)
+	}
+	if opt.Limits.CacheSize, err = parselimit(config.UserMaxCacheSize); err != nil {
+		die("config.UserMaxCacheSize:", err)
+	}
+	if opt.Limits.Daily, err = parselimit(config.UserMaxDaily); err != nil {
+		die("config.UserMaxDaily:", err)
+	}
+	opt.Limits.Files = config.UserMaxFiles
+
+	err = inituploader(config.Destinations, opt)
 	if err != nil {
 		die("can't init uploader", err)
 	}
@@ -67,29 +111,107 @@ func main() {
 		listener, err = net.Listen("unix", *sock)
 	}
 	check(err)
-	defer listener.Close()
+
+	chhup := make(chan os.Signal, 1)
+	signal.Notify(chhup, syscall.SIGHUP)
+	go func() {
+		for range chhup {
+			delivery.Rescan()
+		}
+	}()
 
 	server := NewWebServer(*prefix, *wdir+"/ext")
-	http.Serve(listener, server)
-	check(err)
+	if server.TrustedProxies, err = parsenets(config.TrustedProxies); err != nil {
+		die("config.TrustedProxies:", err)
+	}
+	httpserver := &http.Server{Handler: server}
+
+	var opserver *http.Server
+	if *opaddr != "" {
+		oplistener, err := net.Listen("tcp", *opaddr)
+		check(err)
+		opserver = &http.Server{Handler: server.Operator}
+		go func() {
+			if err := opserver.Serve(oplistener); err != http.ErrServerClosed {
+				log.Println("Operator server failed:", err)
+			}
+		}()
+	}
+
+	chterm := make(chan os.Signal, 1)
+	signal.Notify(chterm, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan bool)
+	go func() {
+		sig := <-chterm
+		signal.Stop(chterm)
+		shutdown(sig, httpserver, server, shutdowntimeout)
+		if opserver != nil {
+			opserver.Close()
+		}
+		if *sock != "" {
+			if err := os.Remove(*sock); err != nil && !os.IsNotExist(err) {
+				log.Println("Can't remove socket:", err)
+			}
+		}
+		close(done)
+	}()
+
+	err = httpserver.Serve(listener)
+	if err != http.ErrServerClosed {
+		check(err)
+	}
+	<-done
+}
+
+// shutdown stops accepting uploads, and waits for active web requests
+// and uploads to destinations to finish. Those still running after
+// timeout are aborted. The state of sessions and the cache is saved.
+func shutdown(sig os.Signal, httpserver *http.Server, server *WebServer, timeout time.Duration) {
+	log.Println("Got", sig, "shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	server.Close()
+	chdelivery := make(chan error, 1)
+	go func() {
+		if cachedir.Encrypted() {
+			// the files can't be read after a restart
+			log.Println("Delivering encrypted files before exit")
+			if err := cachedir.Drain(ctx); err != nil {
+				log.Println("Encrypted files not delivered:", err)
+			}
+		}
+		chdelivery <- delivery.Shutdown(ctx)
+	}()
+	if err := httpserver.Shutdown(ctx); err != nil {
+		log.Println("Aborting web requests:", err)
+		httpserver.Close()
+	}
+	if err := <-chdelivery; err != nil {
+		log.Println("Uploads aborted:", err)
+	}
+
+	server.closesessions()
+	cachedir.Close()
+	log.Println("Shutdown complete")
 }
 
 var (
-	uploader *Uploader
+	delivery *Delivery
 	cachedir *CacheDir
 )
 
-func inituploader(url string, siz int64) (err error) {
-	cachedir, err = OpenCacheDir("", siz)
+func inituploader(dests []DestConfig, opt CacheOptions) (err error) {
+	cachedir, err = OpenCacheDir("", opt)
 	if err != nil {
 		return
 	}
-	uploader, err = NewUploader(url)
+	delivery, err = NewDelivery(dests, cachedir)
 	if err != nil {
 		return
 	}
 	for cached := range cachedir.Files() {
-		err = uploader.Add(cached)
+		err = delivery.Add(cached)
 		if err != nil {
 			cached.Discard()
 		}
@@ -158,6 +280,31 @@ func parsebytesize(s string) (int64, error) {
 	return value, nil
 }
 
+// parsenets parses IP addresses and networks in CIDR notation.
+func parsenets(v []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range v {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 func invalidsize(s string) error {
 	return fmt.Errorf("invalid size %s", s)
 }
@@ -171,9 +318,22 @@ func (b *ByteSize) UnmarshalJSON(p []byte) error {
 }
 
 type config struct {
-	MaxCacheSize string
-	Title        map[Language]string
-	FTPUrl       string
+	MaxCacheSize    string
+	CachePath       string        // default is $XDG_CACHE_HOME/<name of executable>
+	MinFreeSpace    string        // free space kept on the disks of the cache, eg. "1G"
+	CacheVolumes    []CacheVolume // additional directories for cached files
+	ShutdownTimeout string        // eg. "30s"
+	EncryptCache    bool          // encrypt cached files with a key kept in memory
+	TrustedProxies  []string      // reverse proxies setting X-Forwarded-For, eg. "10.0.0.0/8"
+	Title           map[Language]string
+	FTPUrl          string
+	Destination     DestConfig
+	Destinations    []DestConfig
+
+	// Limits of each user, unlimited if empty or zero.
+	UserMaxCacheSize string // bytes waiting for delivery
+	UserMaxFiles     int    // files waiting for delivery
+	UserMaxDaily     string // bytes uploaded per day
 }
 
 func readconfig(fn string) (*config, error) {
@@ -187,5 +347,11 @@ func readconfig(fn string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.Destination.URL == "" {
+		c.Destination.URL = c.FTPUrl
+	}
+	if c.Destination.URL != "" {
+		c.Destinations = append([]DestConfig{c.Destination}, c.Destinations...)
+	}
 	return c, err
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MANIFEST_JSON = "json"
+	MANIFEST_CSV  = "csv"
+
+	MANIFEST_NAME = "manifest"
+)
+
+var manifestcsvheader = []string{"name", "original_name", "size", "sha256", "uploaded", "ip", "lang", "original_size", "original_sha256"}
+
+// columns of the csv manifest before the original size and SHA-256
+const MANIFEST_CSV_OLD_COLUMNS = 7
+
+// Manifest lists the files delivered to a remote directory.
+type Manifest struct {
+	User  string          `json:"user"`
+	Files []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry is a delivered file in the manifest.
+type ManifestEntry struct {
+	Name     string    `json:"name"` // remote filename
+	Original string    `json:"original_name"`
+	Size     int64     `json:"size"`   // of the remote file
+	SHA256   string    `json:"sha256"` // of the remote file
+	Uploaded time.Time `json:"uploaded"`
+	IP       string    `json:"ip"`
+	Lang     string    `json:"lang"`
+
+	// the uploaded content, if encrypted for the destination
+	OriginalSize   int64  `json:"original_size,omitempty"`
+	OriginalSHA256 string `json:"original_sha256,omitempty"`
+}
+
+// content returns the size and SHA-256 of the uploaded content.
+func (e *ManifestEntry) content() (int64, string) {
+	if e.OriginalSHA256 != "" {
+		return e.OriginalSize, e.OriginalSHA256
+	}
+	return e.Size, e.SHA256
+}
+
+func checkmanifest(format string) error {
+	switch format {
+	case "", MANIFEST_JSON, MANIFEST_CSV:
+		return nil
+	}
+	return fmt.Errorf("invalid manifest format: %s", format)
+}
+
+// manifestname returns the filename of the manifest, empty if disabled.
+func (u *Uploader) manifestname() string {
+	if u.manifest == "" {
+		return ""
+	}
+	return MANIFEST_NAME + "." + u.manifest
+}
+
+// updatemanifest adds f stored as p.name to the manifest in userdir.
+// The manifest is stored under a temporary name and renamed if
+// the destination can't store files atomically.
+func (w *worker) updatemanifest(f CachedFile, p *pendingfile, userdir string) error {
+	u := w.u
+	mname := u.manifestname()
+	if mname == "" {
+		return nil
+	}
+	// don't overwrite the manifest if it can't be read
+	m, err := w.findmanifest(userdir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &Manifest{User: strings.ToLower(f.User())}
+	}
+	size, sum := p.storedsum(f)
+	e := ManifestEntry{
+		Name:     p.name,
+		Original: f.Filename(),
+		Size:     size,
+		SHA256:   sum,
+		Uploaded: f.Time(),
+		IP:       f.RemoteAddr(),
+		Lang:     f.Lang(),
+	}
+	if p.enc != nil {
+		e.OriginalSize, e.OriginalSHA256 = f.Size(), f.Sum()
+	}
+	found := false
+	for i := range m.Files {
+		if m.Files[i].Name == p.name {
+			m.Files[i], found = e, true
+		}
+	}
+	if !found {
+		m.Files = append(m.Files, e)
+	}
+	var buf bytes.Buffer
+	if u.manifest == MANIFEST_CSV {
+		err = writemanifestcsv(&buf, m)
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(m)
+	}
+	if err != nil {
+		return err
+	}
+	r, ok := w.dest.(Renamer)
+	if !ok {
+		return w.dest.Store(userdir, mname, &buf, int64(buf.Len()))
+	}
+	tmp := "." + mname + ".tmp"
+	if err = w.dest.Store(userdir, tmp, &buf, int64(buf.Len())); err != nil {
+		return err
+	}
+	return r.Rename(userdir, tmp, mname)
+}
+
+// findmanifest reads the manifest in userdir, it returns nil if there is none.
+func (w *worker) findmanifest(userdir string) (*Manifest, error) {
+	fetcher, ok := w.dest.(Fetcher)
+	if !ok {
+		return nil, fmt.Errorf("destination can't read back the manifest")
+	}
+	mname := w.u.manifestname()
+	names, err := w.dest.List(userdir)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		if path.Base(n) == mname {
+			return w.readmanifest(fetcher, userdir, mname)
+		}
+	}
+	return nil, nil
+}
+
+func (w *worker) readmanifest(fetcher Fetcher, userdir, mname string) (*Manifest, error) {
+	rc, err := fetcher.Fetch(userdir, mname)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ioutil.ReadAll(rc)
+	if errc := rc.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if w.u.manifest == MANIFEST_CSV {
+		m.Files, err = readmanifestcsv(bytes.NewReader(p))
+	} else {
+		err = json.Unmarshal(p, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s/%s: %v", userdir, mname, err)
+	}
+	return m, nil
+}
+
+func writemanifestcsv(wr io.Writer, m *Manifest) error {
+	cw := csv.NewWriter(wr)
+	cw.Write(manifestcsvheader)
+	for _, e := range m.Files {
+		var t string
+		if !e.Uploaded.IsZero() {
+			t = e.Uploaded.Format(time.RFC3339)
+		}
+		var osize string
+		if e.OriginalSHA256 != "" {
+			osize = strconv.FormatInt(e.OriginalSize, 10)
+		}
+		cw.Write([]string{e.Name, e.Original, strconv.FormatInt(e.Size, 10), e.SHA256, t, e.IP, e.Lang, osize, e.OriginalSHA256})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readmanifestcsv(r io.Reader) ([]ManifestEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var v []ManifestEntry
+	for i, rec := range records {
+		if i == 0 || len(rec) != len(manifestcsvheader) && len(rec) != MANIFEST_CSV_OLD_COLUMNS {
+			continue
+		}
+		e := ManifestEntry{Name: rec[0], Original: rec[1], SHA256: rec[3], IP: rec[5], Lang: rec[6]}
+		e.Size, _ = strconv.ParseInt(rec[2], 10, 64)
+		if rec[4] != "" {
+			e.Uploaded, _ = time.Parse(time.RFC3339, rec[4])
+		}
+		if len(rec) > MANIFEST_CSV_OLD_COLUMNS && rec[8] != "" {
+			e.OriginalSize, _ = strconv.ParseInt(rec[7], 10, 64)
+			e.OriginalSHA256 = rec[8]
+		}
+		v = append(v, e)
+	}
+	return v, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestCSV(t *testing.T) {
+	tm := time.Date(2014, 6, 12, 15, 30, 12, 0, time.UTC)
+	m := &Manifest{Files: []ManifestEntry{
+		{"a.txt", "a.txt", 5, "2cf24d", tm, "127.0.0.1", "en", 0, ""},
+		{"b.txt.age", "b.txt", 230, "9f86d0", tm, "::1", "de", 5, "2cf24d"},
+	}}
+	var buf bytes.Buffer
+	if err := writemanifestcsv(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	v, err := readmanifestcsv(&buf)
+	if err != nil || !reflect.DeepEqual(v, m.Files) {
+		t.Errorf("read back %+v, %v", v, err)
+	}
+	// written before the original size and SHA-256 were added
+	old := "name,original_name,size,sha256,uploaded,ip,lang\n" +
+		"a.txt,a.txt,5,2cf24d,2014-06-12T15:30:12Z,127.0.0.1,en\n"
+	v, err = readmanifestcsv(strings.NewReader(old))
+	if err != nil || !reflect.DeepEqual(v, m.Files[:1]) {
+		t.Errorf("read old manifest %+v, %v", v, err)
+	}
+	for i, e := range m.Files {
+		if size, sum := e.content(); size != 5 || sum != "2cf24d" {
+			t.Errorf("entry %d: content %d %s, want 5 2cf24d", i, size, sum)
+		}
+	}
+}
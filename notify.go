@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"sync"
 )
 
@@ -37,6 +38,49 @@ func (n *infopagenotifier) notify(user string) {
 	}
 }
 
+// notifyfold notifies listeners of user, ignoring case.
+func (n *infopagenotifier) notifyfold(user string) {
+	var hv []*userhandler
+	n.mtx.RLock()
+	for u, h := range n.m {
+		if strings.EqualFold(u, user) {
+			hv = append(hv, h)
+		}
+	}
+	n.mtx.RUnlock()
+	for _, h := range hv {
+		h.chupd <- true
+	}
+}
+
+// notifynowait notifies listeners of user ignoring case, like notifyfold,
+// but doesn't wait if a notification is already pending.
+func (n *infopagenotifier) notifynowait(user string) {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	for u, h := range n.m {
+		if strings.EqualFold(u, user) {
+			select {
+			case h.chupd <- true:
+			default:
+			}
+		}
+	}
+}
+
+// notifyall notifies all listeners. It doesn't wait for slow
+// listeners, those having a notification pending get no other.
+func (n *infopagenotifier) notifyall() {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	for _, h := range n.m {
+		select {
+		case h.chupd <- true:
+		default:
+		}
+	}
+}
+
 var notifier = infopagenotifier{m: make(map[string]*userhandler)}
 
 type userhandler struct {
@@ -46,7 +90,9 @@ type userhandler struct {
 
 func handlelisteners(user string) *userhandler {
 	chreg := make(chan *listener)
-	chupd := make(chan bool)
+	// a pending update is kept while a page is being sent,
+	// and covers the updates until it is handled
+	chupd := make(chan bool, 1)
 	go func() {
 		m := make(map[*listener]bool)
 		for {
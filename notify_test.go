@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotifyAllNoWait(t *testing.T) {
+	// a handler busy sending a page to a slow websocket client
+	chupd := make(chan bool, 1)
+	n := &infopagenotifier{m: map[string]*userhandler{"john": {chupd: chupd}}}
+	done := make(chan bool)
+	go func() {
+		n.notifyall()
+		n.notifyall()
+		n.notifynowait("John")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notifyall blocked")
+	}
+	if len(chupd) != 1 {
+		t.Error("update not pending")
+	}
+}
@@ -6,11 +6,14 @@ import (
 )
 
 type InfoPage struct {
-	Name        string
-	Donefiles   []string
-	Cachedfiles []string
-	QueueSize   int64
-	QueueLoad   int
+	Name         string
+	Donefiles    []string
+	Cachedfiles  []string
+	Partialfiles []string
+	Progress     map[string]*Progress // files being uploaded by filename
+	QueueSize    int64
+	QueueLoad    int
+	Status       []Status
 }
 
 func NewInfoPage(user string) *InfoPage {
@@ -19,11 +22,14 @@ func NewInfoPage(user string) *InfoPage {
 	}
 	p := &InfoPage{}
 	p.Name = strings.Title(user)
-	p.Donefiles = uploader.Userfiles(user)
-	sort.Strings(p.Donefiles)
-	p.Cachedfiles = cachedir.Userfiles(user)
+	p.Donefiles = delivery.Userfiles(user)
 	sort.Strings(p.Donefiles)
+	p.Cachedfiles, p.Partialfiles = cachedir.Userfiles(user)
+	sort.Strings(p.Cachedfiles)
+	sort.Strings(p.Partialfiles)
+	p.Progress = delivery.Progress(user)
 	p.QueueSize = cachedir.Size()
 	p.QueueLoad = int(p.QueueSize * 100 / cachedir.MaxSize)
+	p.Status = delivery.Status()
 	return p
 }
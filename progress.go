@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimum time between progress notifications of a transfer
+const PROGRESS_INTERVAL = time.Second
+
+// Progress is the state of a file being uploaded to a destination.
+type Progress struct {
+	Dest     string
+	Filename string
+	Size     int64         // size of the file
+	Sent     int64         // bytes sent, including resumed part
+	Rate     int64         // bytes/s since the start of the attempt
+	ETA      time.Duration // time left, zero if unknown
+}
+
+// Percent returns the part of the file sent.
+func (p *Progress) Percent() int {
+	if p.Size <= 0 {
+		return 0
+	}
+	return int(p.Sent * 100 / p.Size)
+}
+
+// transfer counts the bytes of a file sent by a worker.
+type transfer struct {
+	f    CachedFile
+	mtx  sync.Mutex
+	size int64 // size of the content sent
+	from int64 // offset the attempt started at
+	sent int64
+	at   time.Time // start of the attempt
+	last time.Time // time of last notification
+}
+
+// start sets the offset the upload starts from, and the size of the content.
+func (t *transfer) start(offset, size int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.from, t.sent, t.at, t.size = offset, offset, time.Now(), size
+}
+
+// wrote reports if the attempt has sent any content.
+func (t *transfer) wrote() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.sent > t.from
+}
+
+func (t *transfer) add(n int) {
+	t.mtx.Lock()
+	t.sent += int64(n)
+	notify := time.Since(t.last) >= PROGRESS_INTERVAL
+	if notify {
+		t.last = time.Now()
+	}
+	t.mtx.Unlock()
+	if notify {
+		notifier.notifynowait(t.f.User())
+	}
+}
+
+func (t *transfer) progress(dest string) *Progress {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	p := &Progress{
+		Dest:     dest,
+		Filename: t.f.Filename(),
+		Size:     t.size,
+		Sent:     t.sent,
+	}
+	if d := time.Since(t.at).Seconds(); d > 0 {
+		p.Rate = int64(float64(t.sent-t.from) / d)
+	}
+	if p.Rate > 0 && p.Size > p.Sent {
+		// computed in seconds: the bytes left times time.Second
+		// overflow beyond 9 GB. An ETA too long for a Duration
+		// is unknown.
+		if eta := float64(p.Size-p.Sent) / float64(p.Rate); eta < float64(math.MaxInt64/time.Second) {
+			p.ETA = time.Duration(eta * float64(time.Second)).Round(time.Second)
+		}
+	}
+	return p
+}
+
+// reader returns r counting the bytes read as sent.
+func (t *transfer) reader(r io.Reader) io.Reader {
+	return &countingreader{r, t}
+}
+
+type countingreader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (r *countingreader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.add(n)
+	}
+	return n, err
+}
+
+// settransfer sets the transfer in progress of the worker.
+func (w *worker) settransfer(t *transfer) {
+	w.cmtx.Lock()
+	w.xfer = t
+	w.cmtx.Unlock()
+}
+
+// Progress returns the files of user being uploaded.
+func (u *Uploader) Progress(user string) []*Progress {
+	var v []*Progress
+	for _, w := range u.workers {
+		w.cmtx.Lock()
+		t := w.xfer
+		w.cmtx.Unlock()
+		if t != nil && strings.EqualFold(t.f.User(), user) {
+			v = append(v, t.progress(u.Name))
+		}
+	}
+	return v
+}
+
+// Progress returns the files of user being uploaded by filename. If
+// a file is being uploaded to several destinations, the one least
+// advanced is used.
+func (d *Delivery) Progress(user string) map[string]*Progress {
+	m := make(map[string]*Progress)
+	for _, u := range d.Uploaders {
+		for _, p := range u.Progress(user) {
+			if q, ok := m[p.Filename]; !ok || p.Percent() < q.Percent() {
+				m[p.Filename] = p
+			}
+		}
+	}
+	return m
+}
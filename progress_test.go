@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProgressETA(t *testing.T) {
+	for _, tc := range []struct {
+		size, sent int64 // sent in the 10 s of the attempt
+		eta        time.Duration
+	}{
+		{1000, 0, 0},
+		{1000, 505, 9900 * time.Millisecond},
+		{1000, 1000, 0},
+		// less than a byte per second
+		{3, 1, 0},
+		// slow uploads of large files
+		{20 << 30, 1005, 214748355 * time.Second},
+		{1 << 50, 1<<40 + 5, 10230 * time.Second},
+		{math.MaxInt64, 15, 0},
+	} {
+		xfer := &transfer{f: &CacheEntry{Fn: "a"}}
+		xfer.start(0, tc.size)
+		xfer.at = time.Now().Add(-10 * time.Second)
+		xfer.sent = tc.sent
+		p := xfer.progress("dest")
+		if d := p.ETA - tc.eta; d < -time.Second || d > time.Second {
+			t.Errorf("%d of %d bytes: ETA %v, want %v", tc.sent, tc.size, p.ETA, tc.eta)
+		}
+	}
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"strings"
 	"sync"
+	"time"
 )
 
 type uploadqueue struct {
-	mtx  sync.RWMutex
-	buf  []CachedFile // circular buffer
-	size int          // number of elements in buffer
-	head int          // read position
-	tail int          // write position
-	ch   chan bool    // element added to empty queue
+	mtx  sync.Mutex
+	buf  []CachedFile    // circular buffer
+	size int             // number of elements in buffer
+	head int             // read position
+	tail int             // write position
+	busy map[string]bool // users having a file claimed
+	ch   chan bool       // element added or user released
 }
 
 func newuploadqueue(q []CachedFile) *uploadqueue {
@@ -25,6 +28,7 @@ func newuploadqueue(q []CachedFile) *uploadqueue {
 		size: len(q),
 		head: 0,
 		tail: len(q),
+		busy: make(map[string]bool),
 		ch:   make(chan bool, 1),
 	}
 }
@@ -44,36 +48,83 @@ func (q *uploadqueue) push(u CachedFile) {
 	q.buf[q.tail] = u
 	q.tail = (q.tail + 1) % len(q.buf)
 	q.size++
-	if q.ch != nil && q.size == 1 {
-		q.ch <- true
-	}
+	q.signal()
 }
 
-func (q *uploadqueue) peek() CachedFile {
-	q.mtx.RLock()
-	defer q.mtx.RUnlock()
-	if q.size == 0 {
-		return nil
+// claim returns the first file in the queue whose user has no
+// other file claimed, and marks the user busy until release.
+// The file stays in the queue. Files with notbefore in the future
+// are skipped, together with later files of the same user.
+// Returns nil if there is no such file, and the earliest time
+// one of the skipped files will be available.
+func (q *uploadqueue) claim(notbefore func(f CachedFile) time.Time) (CachedFile, time.Time) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var (
+		now     = time.Now()
+		wait    time.Time
+		waiting map[string]bool
+	)
+	for i := 0; i < q.size; i++ {
+		f := q.buf[(q.head+i)%len(q.buf)]
+		user := strings.ToLower(f.User())
+		if q.busy[user] || waiting[user] {
+			continue
+		}
+		if t := notbefore(f); t.After(now) {
+			if waiting == nil {
+				waiting = make(map[string]bool)
+			}
+			waiting[user] = true
+			if wait.IsZero() || t.Before(wait) {
+				wait = t
+			}
+			continue
+		}
+		q.busy[user] = true
+		if i+1 < q.size {
+			// let other workers check the rest
+			q.signal()
+		}
+		return f, time.Time{}
 	}
-	return q.buf[q.head]
+	return nil, wait
 }
 
-func (q *uploadqueue) pop() {
+// release makes the user of the claimed file f available again,
+// and removes f from the queue if done is true.
+func (q *uploadqueue) release(f CachedFile, done bool) {
 	q.mtx.Lock()
 	defer q.mtx.Unlock()
-	if q.size == 0 {
-		return // panic?
+	delete(q.busy, strings.ToLower(f.User()))
+	if done {
+		q.remove(f)
 	}
-	q.size--
-	if q.size == 0 {
-		q.head, q.tail = 0, 0
-		if q.ch != nil {
-			select {
-			case <-q.ch:
-			default:
-			}
+	q.signal()
+}
+
+func (q *uploadqueue) remove(f CachedFile) {
+	n := len(q.buf)
+	for i := 0; i < q.size; i++ {
+		if q.buf[(q.head+i)%n] != f {
+			continue
+		}
+		for j := i; j+1 < q.size; j++ {
+			q.buf[(q.head+j)%n] = q.buf[(q.head+j+1)%n]
 		}
-	} else {
-		q.head = (q.head + 1) % len(q.buf)
+		q.size--
+		q.tail = (q.head + q.size) % n
+		q.buf[q.tail] = nil
+		if q.size == 0 {
+			q.head, q.tail = 0, 0
+		}
+		return
+	}
+}
+
+func (q *uploadqueue) signal() {
+	select {
+	case q.ch <- true:
+	default:
 	}
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	QUOTA_CACHE = "cache" // bytes in the cache
+	QUOTA_FILES = "files" // files waiting for delivery
+	QUOTA_DAILY = "daily" // bytes uploaded per day
+)
+
+// UserLimits are the limits of a single user, zero means unlimited.
+type UserLimits struct {
+	CacheSize int64 // bytes in the cache
+	Files     int   // files waiting for delivery
+	Daily     int64 // bytes uploaded per day
+}
+
+// QuotaError reports the user limit hit by an upload.
+type QuotaError struct {
+	Limit string // one of QUOTA_*
+	Max   int64
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Limit {
+	case QUOTA_FILES:
+		return fmt.Sprintf("user limit of %d files waiting for delivery reached", e.Max)
+	case QUOTA_DAILY:
+		return fmt.Sprintf("user limit of %d bytes uploaded per day reached", e.Max)
+	}
+	return fmt.Sprintf("user limit of %d cached bytes reached", e.Max)
+}
+
+// DailyUsage is the amount uploaded by a user on a day.
+type DailyUsage struct {
+	Day   string // eg. "2014-06-12"
+	Bytes int64
+}
+
+// userusage is the cache usage of a user.
+type userusage struct {
+	size    int64 // cached bytes, including content being written
+	files   int   // cached files, including files being written
+	writing int64 // bytes allocated for content being written
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// usage returns the usage of user. Must be called with d.mtx held.
+func (d *CacheDir) usage(user string) *userusage {
+	user = strings.ToLower(user)
+	u := d.users[user]
+	if u == nil {
+		u = new(userusage)
+		d.users[user] = u
+	}
+	return u
+}
+
+// daily returns the bytes uploaded by user today.
+// Must be called with d.mtx held.
+func (d *CacheDir) daily(user string) int64 {
+	if u, ok := d.Daily[strings.ToLower(user)]; ok && u.Day == today() {
+		return u.Bytes
+	}
+	return 0
+}
+
+// adddaily adds n bytes uploaded today by user.
+// Must be called with d.mtx held.
+func (d *CacheDir) adddaily(user string, n int64) {
+	user = strings.ToLower(user)
+	u := d.Daily[user]
+	if day := today(); u.Day != day {
+		u = DailyUsage{Day: day}
+	}
+	u.Bytes += n
+	d.Daily[user] = u
+	if err := d.pending.put(DAILY_KEY+user, u); err != nil {
+		d.log.Println("Can't save:", err)
+	}
+}
+
+// prunedaily forgets the usage of past days.
+// Must be called with d.mtx held.
+func (d *CacheDir) prunedaily() {
+	day := today()
+	for user, u := range d.Daily {
+		if u.Day != day {
+			delete(d.Daily, user)
+			d.pending.delete(DAILY_KEY + user)
+		}
+	}
+}
+
+// reservefile counts a new file of user, if the user limit permits.
+func (d *CacheDir) reservefile(user string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	u := d.usage(user)
+	if max := d.limits.Files; max > 0 && u.files >= max {
+		d.log.Println("User", user, "limit:", max, "files")
+		return &QuotaError{QUOTA_FILES, int64(max)}
+	}
+	u.files++
+	return nil
+}
+
+// releasefile undoes reservefile.
+func (d *CacheDir) releasefile(user string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.usage(user).files--
+}
+
+// userlimiter allocates cache space for the content of a user.
+// Err is set if a user limit has been hit by the last allocation.
+type userlimiter struct {
+	d     *CacheDir
+	v     *cachevolume
+	user  string
+	alloc int64
+	err   error
+}
+
+func (l *userlimiter) AllocBytes(n int) bool {
+	d := l.d
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	u, lim := d.usage(l.user), d.limits
+	l.err = nil
+	// uploads being written count against the daily limit
+	// until they are added to the daily usage
+	switch {
+	case lim.CacheSize > 0 && u.size+int64(n) > lim.CacheSize:
+		l.err = &QuotaError{QUOTA_CACHE, lim.CacheSize}
+	case lim.Daily > 0 && d.daily(l.user)+u.writing+int64(n) > lim.Daily:
+		l.err = &QuotaError{QUOTA_DAILY, lim.Daily}
+	case !d.allocbytes(l.v, n):
+		return false
+	default:
+		u.size += int64(n)
+		u.writing += int64(n)
+		l.alloc += int64(n)
+		return true
+	}
+	return false
+}
+
+func (l *userlimiter) FreeBytes(n int) {
+	d := l.d
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.size -= int64(n)
+	l.v.size -= int64(n)
+	u := d.usage(l.user)
+	u.size -= int64(n)
+	u.writing -= int64(n)
+	l.alloc -= int64(n)
+}
+
+// done ends the allocation for content completely written, which
+// stays in the cache. Must be called with d.mtx held.
+func (l *userlimiter) done() {
+	l.d.usage(l.user).writing -= l.alloc
+	l.alloc = 0
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3_MIN_PART_SIZE is the smallest part size allowed by S3 multipart uploads.
+const S3_MIN_PART_SIZE = 5 * 1024 * 1024
+
+// s3Destination stores files as objects in an S3 compatible bucket.
+// User directories are key prefixes below Prefix.
+type s3Destination struct {
+	Bucket, Prefix string
+	PartSize       uint64
+
+	log       *log.Logger
+	client    *minio.Client
+	connected bool
+}
+
+func newS3Destination(u *url.URL, c DestConfig, l *log.Logger) (*s3Destination, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3:// URL needs a bucket name")
+	}
+	endpoint, secure := "s3.amazonaws.com", true
+	if c.Endpoint != "" {
+		e, err := url.Parse(c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Scheme {
+		case "http":
+			secure = false
+		case "https":
+		default:
+			return nil, fmt.Errorf("Endpoint scheme '%s' not supported", e.Scheme)
+		}
+		endpoint = e.Host
+	}
+	var creds *credentials.Credentials
+	if key, secret := urlcredentials(u, ""); key != "" {
+		creds = credentials.NewStaticV4(key, secret, "")
+	} else {
+		creds = credentials.NewEnvAWS()
+	}
+	lookup := minio.BucketLookupAuto
+	if c.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       c.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var partsize int64
+	if c.PartSize != "" {
+		if partsize, err = parsebytesize(c.PartSize); err != nil {
+			return nil, err
+		}
+		if partsize < S3_MIN_PART_SIZE {
+			return nil, fmt.Errorf("PartSize %s is below the S3 minimum of 5MiB", c.PartSize)
+		}
+	}
+	return &s3Destination{
+		Bucket:   u.Host,
+		Prefix:   strings.Trim(u.Path, "/"),
+		PartSize: uint64(partsize),
+		log:      l,
+		client:   client,
+	}, nil
+}
+
+func (d *s3Destination) Connect() error {
+	ok, err := d.client.BucketExists(context.Background(), d.Bucket)
+	if err == nil && !ok {
+		err = fmt.Errorf("bucket %s does not exist", d.Bucket)
+	}
+	if err != nil {
+		d.log.Println("Connection failed:", err)
+		return err
+	}
+	d.connected = true
+	return nil
+}
+
+func (d *s3Destination) Disconnect() error {
+	d.connected = false
+	return nil
+}
+
+func (d *s3Destination) Connected() bool {
+	return d.connected
+}
+
+// Store uploads the content, using a multipart upload if
+// size is larger than the part size.
+func (d *s3Destination) Store(userdir, filename string, r io.Reader, size int64) error {
+	_, err := d.client.PutObject(context.Background(), d.Bucket, d.key(userdir, filename), r, size,
+		minio.PutObjectOptions{PartSize: d.PartSize})
+	return err
+}
+
+// Permanent reports if the object was refused, eg. for its
+// name or size, or because writing it is not permitted.
+func (d *s3Destination) Permanent(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied", "EntityTooLarge", "InvalidObjectName", "KeyTooLongError":
+		return true
+	}
+	return false
+}
+
+func (d *s3Destination) Check(userdir, filename string) (int64, string, error) {
+	info, err := d.client.StatObject(context.Background(), d.Bucket, d.key(userdir, filename), minio.StatObjectOptions{})
+	if err != nil {
+		return 0, "", err
+	}
+	return info.Size, "", nil
+}
+
+func (d *s3Destination) Fetch(userdir, filename string) (io.ReadCloser, error) {
+	obj, err := d.client.GetObject(context.Background(), d.Bucket, d.key(userdir, filename), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject doesn't fail for missing objects
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+// List returns the objects and common prefixes directly below dir.
+func (d *s3Destination) List(dir string) ([]string, error) {
+	prefix := d.key(dir) + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
+	var names []string
+	for obj := range d.client.ListObjects(context.Background(), d.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if name := strings.TrimSuffix(obj.Key[len(prefix):], "/"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (d *s3Destination) key(elem ...string) string {
+	k := path.Join(append([]string{d.Prefix}, elem...)...)
+	if k == "." {
+		return ""
+	}
+	return k
+}
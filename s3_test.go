@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tests3server is an in-memory stand-in for S3 with path-style
+// addressing, supporting the requests used by s3Destination.
+type tests3server struct {
+	bucket string
+	mtx    sync.Mutex
+	objs   map[string][]byte
+	parts  map[string]map[int][]byte // of multipart uploads by upload id
+	nparts int                       // parts uploaded
+}
+
+func newtests3server(t *testing.T, bucket string) (*tests3server, string) {
+	s := &tests3server{bucket: bucket, objs: make(map[string][]byte), parts: make(map[string]map[int][]byte)}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts.URL
+}
+
+func (s *tests3server) object(key string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	b, ok := s.objs[key]
+	return b, ok
+}
+
+// readbody returns the body of req, decoding aws-chunked content.
+func readbody(req *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(req.Body)
+	}
+	var buf bytes.Buffer
+	r := bufio.NewReader(req.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.IndexByte(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// ignore trailers
+			return buf.Bytes(), nil
+		}
+		if _, err = io.CopyN(&buf, r, n); err != nil {
+			return nil, err
+		}
+		if _, err = r.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func s3error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func s3xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *tests3server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	elem := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if elem[0] != s.bucket {
+		s3error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := req.URL.Query()
+	if len(elem) == 1 || elem[1] == "" {
+		switch {
+		case req.Method == "HEAD":
+		case req.Method == "GET" && q["location"] != nil:
+			s3xml(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+			}{})
+		case req.Method == "GET":
+			s.list(w, q.Get("prefix"), q.Get("delimiter"))
+		default:
+			s3error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+	key := elem[1]
+	switch {
+	case req.Method == "HEAD" || req.Method == "GET":
+		b, ok := s.objs[key]
+		if !ok {
+			s3error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(b)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if req.Method == "GET" {
+			w.Write(b)
+		}
+	case req.Method == "PUT":
+		b, err := readbody(req)
+		if err != nil {
+			s3error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if id := q.Get("uploadId"); id != "" {
+			n, _ := strconv.Atoi(q.Get("partNumber"))
+			s.parts[id][n] = b
+			s.nparts++
+		} else {
+			s.objs[key] = b
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(b)))
+	case req.Method == "POST" && q["uploads"] != nil:
+		id := strconv.Itoa(len(s.parts) + 1)
+		s.parts[id] = make(map[int][]byte)
+		s3xml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: s.bucket, Key: key, UploadId: id})
+	case req.Method == "POST" && q.Get("uploadId") != "":
+		parts, ok := s.parts[q.Get("uploadId")]
+		if !ok {
+			s3error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var v []int
+		for n := range parts {
+			v = append(v, n)
+		}
+		sort.Ints(v)
+		var b []byte
+		for _, n := range v {
+			b = append(b, parts[n]...)
+		}
+		s.objs[key] = b
+		delete(s.parts, q.Get("uploadId"))
+		s3xml(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: s.bucket, Key: key, ETag: fmt.Sprintf(`"%x-%d"`, md5.Sum(b), len(v))})
+	default:
+		s3error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers ListObjectsV2 with all objects at once.
+func (s *tests3server) list(w http.ResponseWriter, prefix, delim string) {
+	type object struct {
+		Key          string
+		Size         int
+		ETag         string
+		LastModified string
+	}
+	type common struct {
+		Prefix string
+	}
+	res := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		Delimiter      string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []common
+	}{Name: s.bucket, Prefix: prefix, Delimiter: delim}
+	var keys []string
+	for k := range s.objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delim); delim != "" && i != -1 {
+			if p := k[:len(prefix)+i+len(delim)]; !seen[p] {
+				seen[p] = true
+				res.CommonPrefixes = append(res.CommonPrefixes, common{p})
+			}
+			continue
+		}
+		res.Contents = append(res.Contents, object{k, len(s.objs[k]), fmt.Sprintf(`"%x"`, md5.Sum(s.objs[k])), time.Now().UTC().Format(time.RFC3339)})
+	}
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	s3xml(w, res)
+}
+
+func newtests3dest(t *testing.T, rawurl, endpoint string) *s3Destination {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DestConfig{Endpoint: endpoint, Region: "us-east-1", PathStyle: true, PartSize: "5MiB"}
+	d, err := newS3Destination(u, c, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestS3Destination(t *testing.T) {
+	s, endpoint := newtests3server(t, "archive")
+	d := newtests3dest(t, "s3://key:secret@archive/incoming", endpoint)
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Store("uplood-john", "a.txt", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := s.object("incoming/uplood-john/a.txt"); !ok || string(b) != "hello" {
+		t.Errorf("stored %q, %v, want hello", b, ok)
+	}
+	// larger than the part size
+	big := bytes.Repeat([]byte("0123456789abcdef"), S3_MIN_PART_SIZE/16+1)
+	if err := d.Store("uplood-john", "big", bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := s.object("incoming/uplood-john/big"); !bytes.Equal(b, big) {
+		t.Errorf("stored %d bytes, want %d", len(b), len(big))
+	}
+	if s.nparts != 2 {
+		t.Errorf("stored in %d parts, want 2", s.nparts)
+	}
+	if size, _, err := d.Check("uplood-john", "a.txt"); err != nil || size != 5 {
+		t.Errorf("Check = %d, %v, want 5", size, err)
+	}
+	names, err := d.List("uplood-john")
+	if err != nil || strings.Join(names, " ") != "a.txt big" {
+		t.Errorf("List = %v, %v, want [a.txt big]", names, err)
+	}
+	if names, err = d.List("."); err != nil || strings.Join(names, " ") != "uplood-john" {
+		t.Errorf("List(.) = %v, %v, want [uplood-john]", names, err)
+	}
+	rc, err := d.Fetch("uplood-john", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != "hello" {
+		t.Errorf("fetched %q, %v, want hello", b, err)
+	}
+	if _, err = d.Fetch("uplood-john", "missing"); err == nil {
+		t.Error("fetched a missing object")
+	}
+}
+
+func TestS3MissingBucket(t *testing.T) {
+	_, endpoint := newtests3server(t, "archive")
+	d := newtests3dest(t, "s3://key:secret@other/", endpoint)
+	if err := d.Connect(); err == nil {
+		t.Error("connected to a missing bucket")
+	}
+}
@@ -34,3 +34,17 @@ func (f *bfile) Close() (err error) {
 	// we have atomic rename
 	return os.Rename(f.n+tmp_suffix, f.n)
 }
+
+// syncdir commits the entries of the directory dir to disk, such
+// as a file renamed into it.
+func syncdir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
@@ -72,3 +72,8 @@ func (f *bfile) Close() (err error) {
 	success = err == nil
 	return
 }
+
+// syncdir does nothing, directories can't be synced on windows.
+func syncdir(dir string) error {
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpDestination stores files on an SSH server using SFTP.
+type sftpDestination struct {
+	Addr, RemoteDir string
+	Config          *ssh.ClientConfig
+
+	log    *log.Logger
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+const SFTP_DIAL_TIMEOUT = 30 * time.Second
+
+func newSFTPDestination(u *url.URL, c DestConfig, l *log.Logger) (Destination, error) {
+	user, pass := urlcredentials(u, "")
+	timeout, err := configduration("dial timeout", c.DialTimeout, SFTP_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ClientConfig{User: user, Timeout: timeout}
+	if pass != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(pass))
+	}
+	if c.PrivateKey != "" {
+		signer, err := readsigner(c.PrivateKey, c.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if len(cfg.Auth) == 0 {
+		return nil, fmt.Errorf("sftp: password or private key needed")
+	}
+	hkc, err := pinnedhostkey(c.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HostKeyCallback = hkc
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	return NewSFTPDestination(urlhost(u, "22"), dir, cfg, l), nil
+}
+
+// NewSFTPDestination returns a destination that connects to addr
+// using cfg, and stores files below remotedir.
+func NewSFTPDestination(addr, remotedir string, cfg *ssh.ClientConfig, l *log.Logger) Destination {
+	return &sftpDestination{
+		Addr:      addr,
+		RemoteDir: remotedir,
+		Config:    cfg,
+		log:       l,
+	}
+}
+
+func (d *sftpDestination) Connect() error {
+	conn, err := ssh.Dial("tcp", d.Addr, d.Config)
+	if err != nil {
+		d.log.Println("Connection failed:", err)
+		return err
+	}
+	d.log.Println("Logged in", d.Config.User)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		d.log.Println("Starting SFTP failed:", err)
+		conn.Close()
+		return err
+	}
+	d.conn, d.client = conn, client
+	return nil
+}
+
+func (d *sftpDestination) Disconnect() error {
+	if d.conn == nil {
+		return nil
+	}
+	d.client.Close()
+	err := d.conn.Close()
+	d.conn, d.client = nil, nil
+	return err
+}
+
+func (d *sftpDestination) Connected() bool {
+	return d.conn != nil
+}
+
+func (d *sftpDestination) Store(userdir, filename string, r io.Reader, size int64) error {
+	dir := path.Join(d.RemoteDir, userdir)
+	errmk := d.client.MkdirAll(dir) // don't check, may exist
+	if fi, err := d.client.Stat(dir); err != nil || !fi.IsDir() {
+		d.log.Println("Creating directory", dir, "failed:", errmk, err)
+		if err == nil {
+			err = fmt.Errorf("%s is not a directory", dir)
+		}
+		return err
+	}
+	fn := path.Join(dir, filename)
+	f, err := d.client.Create(fn)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: fn, Err: err}
+	}
+	_, err = f.ReadFrom(r)
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// Permanent reports if the server refused to create the file.
+func (d *sftpDestination) Permanent(err error) bool {
+	var pe *os.PathError
+	return errors.As(err, &pe) && pe.Op == "create" && os.IsPermission(pe.Err)
+}
+
+func (d *sftpDestination) StoredSize(userdir, filename string) (int64, error) {
+	fi, err := d.client.Stat(path.Join(d.RemoteDir, userdir, filename))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (d *sftpDestination) Check(userdir, filename string) (int64, string, error) {
+	size, err := d.StoredSize(userdir, filename)
+	return size, "", err
+}
+
+func (d *sftpDestination) StoreFrom(userdir, filename string, r io.Reader, offset int64) error {
+	f, err := d.client.OpenFile(path.Join(d.RemoteDir, userdir, filename), os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		_, err = f.ReadFrom(r)
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+func (d *sftpDestination) Fetch(userdir, filename string) (io.ReadCloser, error) {
+	return d.client.Open(path.Join(d.RemoteDir, userdir, filename))
+}
+
+// Rename uses the posix-rename extension if available,
+// or removes to before renaming.
+func (d *sftpDestination) Rename(userdir, from, to string) error {
+	dir := path.Join(d.RemoteDir, userdir)
+	from, to = path.Join(dir, from), path.Join(dir, to)
+	if _, ok := d.client.HasExtension("posix-rename@openssh.com"); ok {
+		return d.client.PosixRename(from, to)
+	}
+	if err := d.client.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return d.client.Rename(from, to)
+}
+
+func (d *sftpDestination) List(dir string) ([]string, error) {
+	v, err := d.client.ReadDir(path.Join(d.RemoteDir, dir))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(v))
+	for i, fi := range v {
+		names[i] = fi.Name()
+	}
+	return names, nil
+}
+
+func readsigner(fn, passphrase string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(pem)
+}
+
+// pinnedhostkey returns a callback accepting only the host key hk,
+// specified either in authorized_keys format or as a SHA256 fingerprint.
+func pinnedhostkey(hk string) (ssh.HostKeyCallback, error) {
+	hk = strings.TrimSpace(hk)
+	if hk == "" {
+		return nil, fmt.Errorf("sftp: HostKey missing")
+	}
+	if strings.HasPrefix(hk, "SHA256:") {
+		return func(host string, remote net.Addr, key ssh.PublicKey) error {
+			if fp := ssh.FingerprintSHA256(key); fp != hk {
+				return fmt.Errorf("sftp: host key mismatch for %s: got %s", host, fp)
+			}
+			return nil
+		}, nil
+	}
+	pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hk))
+	if err != nil {
+		return nil, fmt.Errorf("sftp: invalid HostKey: %v", err)
+	}
+	want := pinned.Marshal()
+	return func(host string, remote net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), want) {
+			return fmt.Errorf("sftp: host key mismatch for %s: got %s", host, ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}, nil
+}
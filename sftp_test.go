@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func testhostkey(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newtestsftpserver starts an SSH server accepting user "user" with
+// password "pass", serving SFTP on the local filesystem.
+func newtestsftpserver(t *testing.T, hostkey ssh.Signer) string {
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() != "user" || string(pass) != "pass" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostkey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go servesftp(conn, cfg)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func servesftp(conn net.Conn, cfg *ssh.ServerConfig) {
+	sc, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				// the payload is the subsystem name as an SSH string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				go func() {
+					defer ch.Close()
+					if s, err := sftp.NewServer(ch); err == nil {
+						s.Serve()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func newtestsftpdest(t *testing.T, addr, dir, hostkey string) Destination {
+	u, err := url.Parse("sftp://user:pass@" + addr + filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newSFTPDestination(u, DestConfig{HostKey: hostkey, DialTimeout: "5s"}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSFTPDestination(t *testing.T) {
+	key := testhostkey(t)
+	addr, dir := newtestsftpserver(t, key), t.TempDir()
+	d := newtestsftpdest(t, addr, dir, ssh.FingerprintSHA256(key.PublicKey()))
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Disconnect()
+	if err := d.Store("uplood-john", "a.txt", strings.NewReader("hel"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.(Resumer).StoreFrom("uplood-john", "a.txt", strings.NewReader("lo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "uplood-john", "a.txt"))
+	if err != nil || string(b) != "hello" {
+		t.Errorf("stored %q, %v, want hello", b, err)
+	}
+	if size, _, err := d.(Checker).Check("uplood-john", "a.txt"); err != nil || size != 5 {
+		t.Errorf("Check = %d, %v, want 5", size, err)
+	}
+	names, err := d.List("uplood-john")
+	if err != nil || len(names) != 1 || names[0] != "a.txt" {
+		t.Errorf("List = %v, %v, want [a.txt]", names, err)
+	}
+}
+
+func TestSFTPHostKeyMismatch(t *testing.T) {
+	addr := newtestsftpserver(t, testhostkey(t))
+	other := testhostkey(t)
+	for _, hk := range []string{
+		ssh.FingerprintSHA256(other.PublicKey()),
+		string(ssh.MarshalAuthorizedKey(other.PublicKey())),
+	} {
+		d := newtestsftpdest(t, addr, t.TempDir(), hk)
+		err := d.Connect()
+		if err == nil {
+			d.Disconnect()
+		}
+		if err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+			t.Errorf("HostKey %s: want host key mismatch, got %v", hk, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var statusnames = []string{
+	STATUS_CONNECTING:    "connecting",
+	STATUS_CONNECTED:     "connected",
+	STATUS_ERROR:         "error",
+	STATUS_DISCONNECTING: "disconnecting",
+	STATUS_INACTIVE:      "inactive",
+}
+
+// Status is the connection state of an Uploader.
+type Status struct {
+	Name  string    // destination name
+	State int       // one of the STATUS_ constants
+	Err   string    // last error, cleared when connected
+	Since time.Time // time of last change
+	Retry time.Time // time of next retry, zero if unknown
+
+	Limit  int64     // current bandwidth limit in bytes/s, 0 if unlimited
+	Paused time.Time // end of the current pause, zero if not paused
+}
+
+func (s Status) StateName() string { return statusnames[s.State] }
+func (s Status) Failed() bool      { return s.State == STATUS_ERROR }
+func (s Status) IsPaused() bool    { return !s.Paused.IsZero() }
+
+// RetryIn returns the time left until the next retry.
+func (s Status) RetryIn() time.Duration {
+	d := time.Until(s.Retry).Round(time.Second)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (s Status) String() string {
+	r := s.Name + ": " + s.StateName()
+	if s.Err != "" {
+		r += " (" + s.Err + ")"
+	}
+	if !s.Retry.IsZero() {
+		r += fmt.Sprint(", retry in ", s.RetryIn())
+	}
+	if s.Limit != 0 {
+		r += fmt.Sprint(", limit ", s.Limit, " bytes/s")
+	}
+	if s.IsPaused() {
+		r += ", paused until " + s.Paused.Format("Mon 15:04")
+	}
+	return r
+}
+
+// Status returns the connection state of the uploader.
+func (u *Uploader) Status() Status {
+	u.smtx.RLock()
+	s := u.status
+	u.smtx.RUnlock()
+	now := time.Now()
+	s.Limit, s.Paused = u.sched.limitat(now), u.sched.pausedat(now)
+	return s
+}
+
+// setStatus sets the state of the worker. If retry is
+// nonzero, the next attempt is expected after retry.
+func (w *worker) setStatus(status int, err error, retry time.Duration) {
+	u := w.u
+	u.smtx.Lock()
+	w.status, w.err = status, err
+	if retry != 0 {
+		w.retry = time.Now().Add(retry)
+	} else {
+		w.retry = time.Time{}
+	}
+	changed := w != u.scanner && u.updatestatus()
+	s := u.status
+	u.smtx.Unlock()
+	if changed {
+		u.log.Println("Status:", s)
+		notifier.notifyall()
+	}
+}
+
+// updatestatus combines the states of the workers,
+// and reports if the result is different than before.
+// The first matching state is used in the order: connected,
+// error, connecting, disconnecting, inactive.
+func (u *Uploader) updatestatus() bool {
+	state, serr, retry := STATUS_INACTIVE, "", time.Time{}
+	for _, w := range u.workers {
+		switch {
+		case w.status == STATUS_CONNECTED:
+			state, serr, retry = w.status, "", time.Time{}
+		case state == STATUS_CONNECTED:
+		case w.status == STATUS_ERROR:
+			if state != STATUS_ERROR || (!w.retry.IsZero() && (retry.IsZero() || w.retry.Before(retry))) {
+				state, retry = w.status, w.retry
+				if w.err != nil {
+					serr = w.err.Error()
+				}
+			}
+		case state == STATUS_ERROR:
+		case w.status == STATUS_CONNECTING:
+			state = w.status
+		case state == STATUS_CONNECTING:
+		case w.status == STATUS_DISCONNECTING:
+			state = w.status
+		}
+	}
+	s := &u.status
+	if state != STATUS_ERROR && state != STATUS_CONNECTED {
+		serr = s.Err
+	}
+	if s.State == state && s.Err == serr && s.Retry.Equal(retry) {
+		return false
+	}
+	if s.State != state {
+		s.Since = time.Now()
+	}
+	s.State, s.Err, s.Retry = state, serr, retry
+	return true
+}
+
+// Status returns the connection state of all destinations.
+func (d *Delivery) Status() []Status {
+	v := make([]Status, len(d.Uploaders))
+	for i, u := range d.Uploaders {
+		v[i] = u.Status()
+	}
+	return v
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"code.google.com/p/go.net/idna"
+	"context"
 	"fmt"
-	"github.com/jlaffaye/ftp"
 	"io"
 	"log"
-	"net/url"
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -23,62 +23,223 @@ const (
 	FTP_RECONNECT_DELAY   = 60 * time.Second
 	FTP_DISCONNECT_DELAY  = 60 * time.Second
 	FTP_UPLOAD_FAIL_DELAY = 60 * time.Second
+	FTP_RESCAN_INTERVAL   = 10 * time.Minute
+	FTP_RETRY_MAX_DELAY   = time.Hour
+	FTP_MAX_ATTEMPTS      = 20
+	FTP_ABORT_WAIT        = 5 * time.Second
 
 	USER_DIR_PREFIX = "uplood-"
+
+	// policies for files already existing on the remote side
+	COLLISION_OVERWRITE = "overwrite"
+	COLLISION_SKIP      = "skip"
+	COLLISION_RENAME    = "rename"    // add numeric suffix
+	COLLISION_TIMESTAMP = "timestamp" // add timestamp, and numeric suffix if needed
 )
 
-var ErrQuit = fmt.Errorf("Quitting")
+var (
+	ErrQuit   = fmt.Errorf("Quitting")
+	ErrVerify = fmt.Errorf("verification failed")
+)
 
 type Uploader struct {
-	Addr, User, Pass, RemoteDir string
+	Name      string
+	Collision string
+
+	layout  *layout
+	sched   *schedule
+	limiter *ratelimiter
+	hooks   *hooks
+	enc     encrypter // nil if files are not encrypted
+
+	manifest string // manifest format, empty if disabled
+	skipdup  bool
+
+	reconnectdelay  time.Duration
+	disconnectdelay time.Duration
+	faildelay       time.Duration
+	maxattempts     int           // failed attempts before a file is a dead letter
+	keepalive       time.Duration // 0 if disabled
+
+	log      *log.Logger
+	workers  []*worker
+	scanner  *worker
+	queue    *uploadqueue
+	chquit   chan bool
+	chrescan chan bool
+	quitonce sync.Once
+	wg       sync.WaitGroup // running workers
+
+	fmtx      sync.RWMutex
+	files     map[string][]string
+	scanadded map[string][]string // files added during a rescan
+
+	pmtx sync.Mutex
+	pend map[CachedFile]*pendingfile
+	dead []CachedFile                 // dead letters
+	sums map[string]map[string]string // remote path by user and SHA-256 of delivered files
 
-	log    *log.Logger
-	conn   *ftp.ServerConn
+	smtx   sync.RWMutex
+	status Status
+
+	// called after a file has been uploaded
+	delivered func(u *Uploader, f CachedFile)
+
+	// cache directory holding the encrypted copies of files
+	tmp *CacheDir
+}
+
+// pendingfile is the upload state of a file kept between attempts.
+// It is only accessed by the worker having the file claimed, except
+// for name, which is set with u.pmtx held for other workers choosing
+// names in the same directory.
+type pendingfile struct {
+	dir      string         // remote directory
+	enc      *encryptedcopy // encrypted content, if encryption is enabled
+	name     string         // remote filename
+	partial  bool           // remote file may be incomplete
+	stored   bool           // file is stored, the manifest is not updated yet
+	attempts int            // failed attempts
+	next     time.Time      // time of next attempt
+}
+
+// worker uploads files from the queue using its own connection.
+type worker struct {
+	u    *Uploader
+	log  *log.Logger
+	dest Destination
+
+	// protected by u.smtx
 	status int
 	err    error
-	queue  *uploadqueue
-	chquit chan bool
+	retry  time.Time
+
+	used   time.Time // last upload or connect
+	active time.Time // last command sent
 
-	fmtx  sync.RWMutex
-	files map[string][]string
+	cmtx    sync.Mutex
+	content io.Closer // content being uploaded
+	xfer    *transfer // progress of the upload
 }
 
-func NewUploader(rawurl string) (*Uploader, error) {
-	url, err := url.Parse(rawurl)
+// NewUploader creates an uploader for the destination c.
+// If delivered is nil, files are discarded after upload.
+func NewUploader(c DestConfig, delivered func(u *Uploader, f CachedFile)) (*Uploader, error) {
+	nw := c.Workers
+	if nw < 0 {
+		return nil, fmt.Errorf("invalid number of workers: %d", nw)
+	}
+	if nw == 0 {
+		nw = 1
+	}
+	switch c.Collision {
+	case "":
+		c.Collision = COLLISION_OVERWRITE
+	case COLLISION_OVERWRITE, COLLISION_SKIP, COLLISION_RENAME, COLLISION_TIMESTAMP:
+	default:
+		return nil, fmt.Errorf("invalid collision policy: %s", c.Collision)
+	}
+	rescan, err := configduration("rescan interval", c.Rescan, FTP_RESCAN_INTERVAL)
 	if err != nil {
 		return nil, err
 	}
-	if url.Scheme != "ftp" {
-		return nil, fmt.Errorf("URL scheme '%s' not supported", url.Scheme)
+	var delays [4]time.Duration
+	for i, d := range []struct {
+		name, s string
+		def     time.Duration
+	}{
+		{"reconnect delay", c.ReconnectDelay, FTP_RECONNECT_DELAY},
+		{"disconnect delay", c.DisconnectDelay, FTP_DISCONNECT_DELAY},
+		{"fail delay", c.FailDelay, FTP_UPLOAD_FAIL_DELAY},
+		{"keepalive interval", c.Keepalive, 0},
+	} {
+		if delays[i], err = configduration(d.name, d.s, d.def); err != nil {
+			return nil, err
+		}
+	}
+	if delays[0] == 0 || delays[2] == 0 {
+		return nil, fmt.Errorf("reconnect and fail delays must be positive")
 	}
-	addr := url.Host
-	if strings.IndexRune(addr, ':') == -1 {
-		addr += ":21"
+	maxattempts := c.MaxAttempts
+	if maxattempts < 0 {
+		return nil, fmt.Errorf("invalid number of attempts: %d", maxattempts)
 	}
-	var user, pass string
-	if url.User != nil {
-		user = url.User.Username()
-		var ok bool
-		if pass, ok = url.User.Password(); !ok {
-			pass = "anonymous"
-		}
+	if maxattempts == 0 {
+		maxattempts = FTP_MAX_ATTEMPTS
+	}
+	layout, err := newlayout(c.Layout)
+	if err != nil {
+		return nil, err
+	}
+	sched, err := newschedule(c)
+	if err != nil {
+		return nil, err
+	}
+	if delivered == nil {
+		delivered = func(u *Uploader, f CachedFile) { f.Discard() }
 	}
 	u := &Uploader{
-		Addr:      addr,
-		User:      user,
-		Pass:      pass,
-		RemoteDir: url.Path,
+		Name:      destname(c),
+		Collision: c.Collision,
+		layout:    layout,
+		sched:     sched,
+		limiter:   &ratelimiter{sched: sched},
+
+		reconnectdelay:  delays[0],
+		disconnectdelay: delays[1],
+		faildelay:       delays[2],
+		maxattempts:     maxattempts,
+		keepalive:       delays[3],
+		log:             log.New(os.Stderr, "FTP     ", log.LstdFlags),
+		queue:           newuploadqueue(nil),
+		chquit:          make(chan bool),
+		chrescan:        make(chan bool, 1),
+		files:           make(map[string][]string),
 
-		log:    log.New(os.Stderr, "FTP     ", log.LstdFlags),
-		queue:  newuploadqueue(nil),
-		chquit: make(chan bool),
-		files:  make(map[string][]string),
+		pend:      make(map[CachedFile]*pendingfile),
+		delivered: delivered,
 	}
+	u.status = Status{Name: u.Name, State: STATUS_INACTIVE, Since: time.Now()}
+	for i := 0; i <= nw; i++ {
+		l := u.log
+		if nw > 1 || i == nw {
+			l = log.New(os.Stderr, "", log.LstdFlags)
+		}
+		dest, err := NewDestination(c, l)
+		if err != nil {
+			return nil, err
+		}
+		w := &worker{u: u, log: l, dest: dest, status: STATUS_INACTIVE}
+		if i < nw {
+			u.workers = append(u.workers, w)
+		} else {
+			u.scanner = w
+		}
+	}
+	if u.enc, err = newencrypter(c); err != nil {
+		return nil, err
+	}
+	if err = checkmanifest(c.Manifest); err != nil {
+		return nil, err
+	}
+	u.manifest = c.Manifest
+	u.skipdup = c.SkipDuplicates
+	if u.hooks, err = newhooks(c, u.log); err != nil {
+		return nil, err
+	}
+	if _, ok := u.scanner.dest.(Keeper); !ok && u.keepalive != 0 {
+		return nil, fmt.Errorf("keepalive is not supported by the destination")
+	}
+	u.setlogprefix("FTP     ")
 	err = u.find_files()
 	if err != nil {
 		return nil, err
 	}
-	go u.run()
+	for _, w := range u.workers {
+		u.wg.Add(1)
+		go w.run()
+	}
+	go u.rescanner(rescan)
 	return u, nil
 }
 
@@ -87,15 +248,57 @@ func (u *Uploader) Add(f CachedFile) error {
 	if err != nil {
 		return err
 	}
+	if err = u.layout.check(f.User()); err != nil {
+		return err
+	}
 	u.queue.push(f)
 	return nil
 }
 
+// Close stops the uploader. Workers finish the files
+// being uploaded, but don't start new ones.
 func (u *Uploader) Close() error {
-	close(u.chquit)
+	u.quitonce.Do(func() {
+		close(u.chquit)
+	})
 	return nil
 }
 
+// Shutdown closes the uploader and waits for the workers to finish.
+// Uploads still in progress when ctx is done are aborted.
+func (u *Uploader) Shutdown(ctx context.Context) error {
+	u.Close()
+	done := make(chan bool)
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	u.log.Println("Aborting uploads")
+	for _, w := range u.workers {
+		w.abort()
+	}
+	select {
+	case <-done:
+	case <-time.After(FTP_ABORT_WAIT):
+		u.log.Println("Workers still running, giving up")
+	}
+	return ctx.Err()
+}
+
+// Rescan requests the list of uploaded files
+// to be refreshed from the remote side.
+func (u *Uploader) Rescan() {
+	select {
+	case u.chrescan <- true:
+	default:
+	}
+}
+
 func (u *Uploader) Userfiles(uploader string) []string {
 	uploader = strings.ToLower(uploader)
 	u.fmtx.RLock()
@@ -103,179 +306,632 @@ func (u *Uploader) Userfiles(uploader string) []string {
 	return u.files[uploader]
 }
 
-func (u *Uploader) setStatus(status int, err error) {
+// setlogprefix sets the log prefix for the uploader and its workers.
+func (u *Uploader) setlogprefix(p string) {
+	u.log.SetPrefix(p)
+	if len(u.workers) > 1 {
+		for i, w := range u.workers {
+			w.log.SetPrefix(fmt.Sprintf("%s#%d ", p, i+1))
+		}
+	}
+	u.scanner.log.SetPrefix(p + "scan ")
 }
 
-func (u *Uploader) connect(once bool) error {
-	for u.conn == nil {
-		u.log.Println("Connecting")
-		u.setStatus(STATUS_CONNECTING, nil)
-		conn, err := ftp.Connect(u.Addr)
+func (w *worker) connect(once bool) error {
+	for !w.dest.Connected() {
+		w.log.Println("Connecting")
+		w.setStatus(STATUS_CONNECTING, nil, 0)
+		err := w.dest.Connect()
 		if err == nil {
-			u.log.Println("Logging in", u.User)
-			err = conn.Login(u.User, u.Pass)
-			if err == nil {
-				u.log.Println("Login successful")
-				u.conn = conn
-				u.setStatus(STATUS_CONNECTED, nil)
-				break
-			} else {
-				u.log.Println("Login failed:", err)
-			}
-		} else {
-			u.log.Println("Connection failed:", err)
+			w.setStatus(STATUS_CONNECTED, nil, 0)
+			w.touch()
+			break
 		}
-		u.setStatus(STATUS_ERROR, err)
 		if once {
+			w.setStatus(STATUS_ERROR, err, 0)
 			return err
 		}
+		w.setStatus(STATUS_ERROR, err, w.u.reconnectdelay)
 		select {
-		case <-time.After(FTP_RECONNECT_DELAY):
-		case <-u.chquit:
+		case <-time.After(w.u.reconnectdelay):
+		case <-w.u.chquit:
 			return ErrQuit
 		}
 	}
 	return nil
 }
 
-func (u *Uploader) disconnect(xerr error) {
-	if u.conn != nil {
-		u.log.Println("Disconnecting")
-		u.setStatus(STATUS_DISCONNECTING, nil)
-		if err := u.conn.Quit(); err != nil {
-			u.log.Println("Disconnect failed:", err)
+func (w *worker) disconnect(xerr error) {
+	if w.dest.Connected() {
+		w.log.Println("Disconnecting")
+		w.setStatus(STATUS_DISCONNECTING, nil, 0)
+		if err := w.dest.Disconnect(); err != nil {
+			w.log.Println("Disconnect failed:", err)
 		}
-		u.conn = nil
 		if xerr == nil {
-			u.setStatus(STATUS_INACTIVE, nil)
+			w.setStatus(STATUS_INACTIVE, nil, 0)
 		} else {
-			u.setStatus(STATUS_ERROR, xerr)
-			time.Sleep(FTP_UPLOAD_FAIL_DELAY)
+			w.setStatus(STATUS_ERROR, xerr, w.u.faildelay)
+			select {
+			case <-time.After(w.u.faildelay):
+			case <-w.u.chquit:
+			}
 		}
 	}
 }
 
-func (u *Uploader) upload(encname, filename string, content io.ReadCloser) bool {
-	err := u.conn.ChangeDir(u.RemoteDir)
+// upload sends the content of f, and returns the remote filename used.
+func (w *worker) upload(f CachedFile, content io.ReadSeekCloser) (string, error) {
+	p := w.u.pending(f)
+	if p.dir == "" {
+		dir, err := w.u.layout.expand(f)
+		if err != nil {
+			content.Close()
+			return "", err
+		}
+		p.dir = dir
+	}
+	userdir := p.dir
+	xfer := &transfer{f: f}
+	xfer.start(0, f.Size())
+	w.settransfer(xfer)
+	defer func() {
+		w.settransfer(nil)
+		notifier.notifynowait(f.User())
+	}()
+	if p.name == "" {
+		if dup := w.duplicate(f, userdir); dup != "" {
+			content.Close()
+			w.log.Println("File", f.User()+"/"+f.Filename(), "has the same content as", dup, ", skipped")
+			w.u.forget(f)
+			return path.Base(dup), nil
+		}
+	}
+	if p.stored {
+		// only the manifest is missing
+		content.Close()
+	} else {
+		skip, err := w.choosename(f, p, userdir)
+		if err != nil || skip {
+			content.Close()
+		}
+		switch {
+		case err != nil:
+			// the connection is lost
+			w.log.Println("Upload of", userdir+"/"+f.Filename(), "failed:", err)
+			return "", err
+		case skip:
+			w.log.Println("File", userdir+"/"+p.name, "exists, skipped")
+			w.u.forget(f)
+			return p.name, nil
+		}
+		if err = w.store(f, p, userdir, content, xfer); err != nil {
+			return "", err
+		}
+		p.stored = true
+		w.log.Println("File", userdir+"/"+p.name, "uploaded")
+	}
+	if err := w.updatemanifest(f, p, userdir); err != nil {
+		// keep the file until the manifest lists it
+		w.log.Println("Updating manifest in", userdir, "failed:", err)
+		if !replyerror(err) {
+			w.disconnect(err)
+		}
+		return "", fmt.Errorf("updating manifest: %v", err)
+	}
+	w.u.forget(f)
+	w.u.adddelivered(f, userdir+"/"+p.name)
+	w.u.hooks.delivered(w.u.Name, f, userdir+"/"+p.name, p.enc)
+	return p.name, nil
+}
+
+// store sends the content of f as p.name, checks
+// the remote file and closes the content.
+func (w *worker) store(f CachedFile, p *pendingfile, userdir string, content io.ReadSeekCloser, xfer *transfer) error {
+	pl, err := w.payload(f, p, content)
 	if err != nil {
-		u.log.Println("CD to remote dir", u.RemoteDir, "failed:", err)
-		u.disconnect(err)
-		return false
+		// the connection is fine, retry later
+		w.log.Println("Preparing", f.User()+"/"+f.Filename(), "failed:", err)
+		return err
+	}
+	content = pl.r
+	w.setcontent(content)
+	err = w.resume(pl, p, userdir, xfer)
+	if err == ErrNoResume {
+		xfer.start(0, pl.size)
+		err = w.dest.Store(userdir, p.name, w.u.limiter.reader(xfer.reader(content)), pl.size)
+	}
+	if err == nil {
+		err = w.verify(pl, p, userdir)
 	}
-	userdir := USER_DIR_PREFIX + encname
-	errmk := u.conn.MakeDir(userdir) // don't check, may exist
-	err = u.conn.ChangeDir(userdir)
 	if err != nil {
-		u.log.Println("Creating/changing to directory", userdir, "failed:", errmk, err)
-		u.disconnect(err)
+		content.Close()
+		// resume only what this attempt or an earlier one has written,
+		// and never after a verification failure
+		p.partial = err != ErrVerify && (p.partial || xfer.wrote())
+		w.log.Println("Upload of", userdir+"/"+p.name, "failed:", err)
+		if !replyerror(err) {
+			// connection may be broken
+			w.disconnect(err)
+		}
+		return err
+	}
+	if err = content.Close(); err != nil {
+		w.log.Println("Close failed:", err)
+	}
+	return nil
+}
+
+// choosename sets the remote filename for f according to the
+// collision policy, unless it has been chosen in a previous attempt.
+// It returns true if the upload should be skipped.
+func (w *worker) choosename(f CachedFile, p *pendingfile, userdir string) (skip bool, err error) {
+	if p.name != "" {
+		return false, nil
+	}
+	name := f.Filename()
+	if mname := w.u.manifestname(); mname != "" && strings.EqualFold(name, mname) {
+		// don't overwrite the manifest
+		name = "_" + name
+	}
+	sfx := w.u.suffix()
+	policy := w.u.Collision
+	if policy == COLLISION_OVERWRITE {
+		w.u.pmtx.Lock()
+		p.name = name + sfx
+		w.u.pmtx.Unlock()
+		return false, nil
+	}
+	taken := make(map[string]bool)
+	if v, errl := w.dest.List(userdir); errl == nil {
+		for _, fn := range v {
+			taken[w.u.displayname(path.Base(fn))] = true
+		}
+	} else if w.dest.Connected() {
+		// user directory may not exist yet
+		w.log.Println("Listing", userdir, "failed:", errl)
+	} else {
+		return false, errl
+	}
+	// names chosen by other workers aren't listed yet
+	w.u.pmtx.Lock()
+	defer w.u.pmtx.Unlock()
+	for pf, pp := range w.u.pend {
+		if pf != f && pp.name != "" && pp.dir == userdir {
+			taken[w.u.displayname(pp.name)] = true
+		}
+	}
+	if taken[name] {
+		ext := path.Ext(name)
+		base := name[:len(name)-len(ext)]
+		switch policy {
+		case COLLISION_SKIP:
+			p.name = name + sfx
+			return true, nil
+		case COLLISION_TIMESTAMP:
+			base += time.Now().Format("-20060102-150405")
+			name = base + ext
+		}
+		for i := 1; taken[name]; i++ {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		w.log.Println("File", userdir+"/"+f.Filename(), "exists, using", name)
+	}
+	p.name = name + sfx
+	return false, nil
+}
+
+// resume continues a previously failed upload of f from the size
+// already on the remote side. It returns ErrNoResume if the upload
+// has to be started from the beginning.
+func (w *worker) resume(pl *payload, p *pendingfile, userdir string, xfer *transfer) error {
+	r, ok := w.dest.(Resumer)
+	if !ok || !p.partial {
+		return ErrNoResume
+	}
+	fn := userdir + "/" + p.name
+	offset, err := r.StoredSize(userdir, p.name)
+	if err != nil || offset <= 0 || offset > pl.size {
+		return ErrNoResume
+	}
+	if offset == pl.size {
+		// the size alone doesn't tell if the content is ours
+		if !w.samesum(pl, userdir, p.name) {
+			return ErrNoResume
+		}
+		w.log.Println("File", fn, "already complete")
+		return nil
+	}
+	if _, err = pl.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	w.log.Println("Resuming", fn, "at", offset, "of", pl.size, "bytes")
+	xfer.start(offset, pl.size)
+	err = r.StoreFrom(userdir, p.name, w.u.limiter.reader(xfer.reader(pl.r)), offset)
+	if err == ErrNoResume {
+		if _, errs := pl.r.Seek(0, io.SeekStart); errs != nil {
+			return errs
+		}
+	}
+	return err
+}
+
+// samesum reports if the remote file has the SHA-256 of the payload.
+// It is false if the destination can't tell.
+func (w *worker) samesum(pl *payload, userdir, name string) bool {
+	c, ok := w.dest.(Checker)
+	if !ok || pl.sum == "" {
 		return false
 	}
-	err = u.conn.Stor(filename, content)
+	_, sum, err := c.Check(userdir, name)
+	return err == nil && sum == pl.sum
+}
+
+// verify checks the uploaded file f, if the destination supports it.
+func (w *worker) verify(pl *payload, p *pendingfile, userdir string) error {
+	c, ok := w.dest.(Checker)
+	if !ok {
+		return nil
+	}
+	size, sum, err := c.Check(userdir, p.name)
 	if err != nil {
-		u.log.Println("Upload of", encname+"/"+filename, "failed:", err)
-		u.disconnect(err)
-		return false
+		return err
+	}
+	fn := userdir + "/" + p.name
+	if size != -1 && size != pl.size {
+		w.log.Println("File", fn, "has", size, "bytes instead of", pl.size, ", re-queued")
+		return ErrVerify
 	}
-	u.log.Println("File", encname+"/"+filename, "uploaded")
-	err = content.Close()
+	if sum != "" && pl.sum != "" && sum != pl.sum {
+		w.log.Println("File", fn, "has SHA-256", sum, "instead of", pl.sum, ", re-queued")
+		return ErrVerify
+	}
+	return nil
+}
+
+// pending returns the upload state of f, kept between attempts.
+func (u *Uploader) pending(f CachedFile) *pendingfile {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	p, ok := u.pend[f]
+	if !ok {
+		p = new(pendingfile)
+		u.pend[f] = p
+	}
+	return p
+}
+
+// forget drops the upload state of f.
+func (u *Uploader) forget(f CachedFile) {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	if p, ok := u.pend[f]; ok && p.enc != nil {
+		p.enc.remove()
+	}
+	delete(u.pend, f)
+}
+
+// adddelivered records the content of f delivered as remotepath.
+func (u *Uploader) adddelivered(f CachedFile, remotepath string) {
+	if !u.skipdup || f.Sum() == "" {
+		return
+	}
+	user := strings.ToLower(f.User())
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	if u.sums == nil {
+		u.sums = make(map[string]map[string]string)
+	}
+	if u.sums[user] == nil {
+		u.sums[user] = make(map[string]string)
+	}
+	u.sums[user][f.Sum()] = remotepath
+}
+
+// duplicate returns the remote path of a file with the same content
+// as f already delivered for the user, or an empty string.
+func (w *worker) duplicate(f CachedFile, userdir string) string {
+	u := w.u
+	if !u.skipdup || f.Sum() == "" {
+		return ""
+	}
+	user := strings.ToLower(f.User())
+	u.pmtx.Lock()
+	dup := u.sums[user][f.Sum()]
+	u.pmtx.Unlock()
+	if dup != "" {
+		if w.exists(dup) {
+			return dup
+		}
+		// removed from the remote side
+		u.pmtx.Lock()
+		if u.sums[user][f.Sum()] == dup {
+			delete(u.sums[user], f.Sum())
+		}
+		u.pmtx.Unlock()
+	}
+	if u.manifestname() == "" {
+		return ""
+	}
+	// the directory may not exist yet, errors are handled by the upload
+	m, err := w.findmanifest(userdir)
+	if err != nil || m == nil {
+		return ""
+	}
+	for _, e := range m.Files {
+		if size, sum := e.content(); sum == f.Sum() && size == f.Size() && w.exists(userdir+"/"+e.Name) {
+			return userdir + "/" + e.Name
+		}
+	}
+	return ""
+}
+
+// exists reports if the remote file fn is listed in its directory.
+func (w *worker) exists(fn string) bool {
+	names, err := w.dest.List(path.Dir(fn))
 	if err != nil {
-		u.log.Println("Close failed:", err)
+		return false
+	}
+	for _, n := range names {
+		if path.Base(n) == path.Base(fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// prunesums forgets the content of delivered files
+// no longer found on the remote side by a rescan.
+func (u *Uploader) prunesums(files map[string][]string) {
+	u.pmtx.Lock()
+	defer u.pmtx.Unlock()
+	for user, sums := range u.sums {
+		found := make(map[string]bool, len(files[user]))
+		for _, fn := range files[user] {
+			found[fn] = true
+		}
+		for sum, remotepath := range sums {
+			if !found[u.displayname(path.Base(remotepath))] {
+				delete(sums, sum)
+			}
+		}
+		if len(sums) == 0 {
+			delete(u.sums, user)
+		}
 	}
-	return true
 }
 
 func (u *Uploader) add_file(user, filename string) {
 	u.fmtx.Lock()
 	defer u.fmtx.Unlock()
 	user = strings.ToLower(user)
-	v := u.files[user]
-	for _, fn := range v {
-		if filename == fn {
-			return
-		}
+	u.files[user] = appendnew(u.files[user], filename)
+	if u.scanadded != nil {
+		u.scanadded[user] = appendnew(u.scanadded[user], filename)
 	}
-	u.files[user] = append(v, filename)
 }
 
+// find_files gets the list of uploaded files from the remote
+// side. Users whose list of files changed are notified.
 func (u *Uploader) find_files() (err error) {
-	if err = u.connect(true); err != nil {
+	w := u.scanner
+	if err = w.connect(true); err != nil {
 		return
 	}
+	u.fmtx.Lock()
+	u.scanadded = make(map[string][]string)
+	u.fmtx.Unlock()
 	defer func() {
 		if err != nil {
-			u.disconnect(err)
+			u.fmtx.Lock()
+			u.scanadded = nil
+			u.fmtx.Unlock()
 		}
+		w.disconnect(err)
 	}()
-	if err = u.conn.ChangeDir(u.RemoteDir); err != nil {
-		u.log.Println("CD to remote dir", u.RemoteDir, "failed:", err)
-		return err
-	}
-	var unames []string
-	if unames, err = u.conn.NameList("."); err != nil {
+	files := make(map[string][]string)
+	if err = u.walk(".", 0, "", files); err != nil {
 		u.log.Println("Can't get list of users")
 		return err
 	}
-	nu, nf := 0, 0
-	for _, name := range unames {
-		if strings.HasPrefix(name, USER_DIR_PREFIX) {
-			user, err := Decodename(name[len(USER_DIR_PREFIX):])
-			if user == "" || err != nil {
-				u.log.Println("Unexpected file/folder:", name[len(USER_DIR_PREFIX):], err)
-				continue
+	nf := 0
+	for _, v := range files {
+		nf += len(v)
+	}
+	nu := len(files)
+	u.log.Println("Found", nf, "files for", nu, "users")
+
+	var changed []string
+	u.fmtx.Lock()
+	for user, v := range u.scanadded {
+		for _, fn := range v {
+			files[user] = appendnew(files[user], fn)
+		}
+	}
+	u.scanadded = nil
+	for user, v := range files {
+		if !sameset(v, u.files[user]) {
+			changed = append(changed, user)
+		}
+	}
+	for user := range u.files {
+		if _, ok := files[user]; !ok {
+			changed = append(changed, user)
+		}
+	}
+	u.files = files
+	u.fmtx.Unlock()
+	u.prunesums(files)
+
+	for _, user := range changed {
+		notifier.notifyfold(user)
+	}
+	return
+}
+
+// walk lists the files in the remote directories below dir matching
+// the layout from path element i. User is the user found in dir, if any.
+func (u *Uploader) walk(dir string, i int, user string, files map[string][]string) error {
+	w := u.scanner
+	names, err := w.dest.List(dir)
+	if err != nil {
+		if i == 0 {
+			return err
+		}
+		w.log.Println("Listing", dir, "failed:", err)
+		if user != "" {
+			// keep what we know
+			for _, fn := range u.Userfiles(user) {
+				files[user] = appendnew(files[user], fn)
 			}
-			if user != "" {
-				nu++
-				var fnames []string
-				if fnames, err = u.conn.NameList(name); err != nil {
-					u.log.Println("Getting filenames for", user, "failed:", err)
-				} else {
-					l := make([]string, 0, len(fnames))
-					for _, n := range fnames {
-						if len(n) != 0 && n[0] != '.' && n != "Thumbs.db" {
-							l = append(l, n)
-						}
-					}
-					u.files[user] = l
-					nf += len(l)
-				}
+		}
+		return nil
+	}
+	if i == u.layout.depth() {
+		user = strings.ToLower(user)
+		if _, ok := files[user]; !ok {
+			files[user] = nil
+		}
+		for _, n := range names {
+			n = path.Base(n)
+			if len(n) != 0 && n[0] != '.' && n != "Thumbs.db" && n != u.manifestname() {
+				files[user] = appendnew(files[user], u.displayname(n))
 			}
 		}
+		return nil
 	}
-	u.log.Println("Found", nf, "files for", nu, "users")
-	return
+	for _, name := range names {
+		name = path.Base(name)
+		if name == "." || name == ".." {
+			continue
+		}
+		eluser, ok, err := u.layout.matchelem(i, name)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			u.log.Println("Unexpected file/folder:", path.Join(dir, name), err)
+			continue
+		}
+		if eluser == "" {
+			eluser = user
+		}
+		u.walk(path.Join(dir, name), i+1, eluser, files)
+	}
+	return nil
+}
+
+// rescanner refreshes the list of uploaded files periodically,
+// and when requested by Rescan. Interval zero disables periodic rescans.
+func (u *Uploader) rescanner(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-u.chrescan:
+		case <-u.chquit:
+			return
+		}
+		if err := u.find_files(); err != nil {
+			u.log.Println("Rescan failed:", err)
+		}
+	}
+}
+
+func appendnew(v []string, s string) []string {
+	for _, e := range v {
+		if e == s {
+			return v
+		}
+	}
+	return append(v, s)
 }
 
-func (u *Uploader) run() {
+func sameset(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]bool, len(a))
+	for _, s := range a {
+		m[s] = true
+	}
+	for _, s := range b {
+		if !m[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *worker) run() {
+	u := w.u
 	defer func() {
-		u.disconnect(nil)
+		w.disconnect(nil)
+		u.wg.Done()
 	}()
 	for {
-		if f := u.queue.peek(); f != nil {
+		select {
+		case <-u.chquit:
+			return
+		default:
+		}
+		if end := u.sched.pausedat(time.Now()); !end.IsZero() {
+			w.pause(end)
+			continue
+		}
+		f, wait := u.queue.claim(u.notbefore)
+		if f != nil {
 			content, err := f.Open()
 			if err != nil {
-				log.Println("Can't open content for ", f.User()+"/"+f.Filename(), ", dropping")
-				u.queue.pop()
+				w.log.Println("Can't open content for ", f.User()+"/"+f.Filename(), ", dropping")
+				u.queue.release(f, true)
+				u.forget(f)
 				f.Discard()
 				continue
 			}
-			if u.connect(false) != nil {
+			if w.connect(false) != nil {
+				content.Close()
+				u.queue.release(f, false)
 				return
 			}
-			encname, err := Encodename(f.User())
-			if err != nil {
-				panic(err) // can't happen Encodename is called in Add()
-			}
-			if u.upload(encname, f.Filename(), content) {
-				u.add_file(f.User(), f.Filename())
-				u.queue.pop()
-				f.Discard()
+			w.setcontent(content)
+			fn, err := w.upload(f, content)
+			w.setcontent(nil)
+			w.touch()
+			switch {
+			case err == nil:
+				u.add_file(f.User(), u.displayname(fn))
+				u.queue.release(f, true)
+				u.delivered(u, f)
+			case w.permanent(err):
+				u.queue.release(f, true)
+				u.setdead(f, err)
+			case !u.backoff(f):
+				u.queue.release(f, true)
+				u.setdead(f, fmt.Errorf("%d attempts failed, last: %v", u.maxattempts, err))
+			default:
+				u.queue.release(f, false)
 			}
 		} else {
+			var retry <-chan time.Time
+			if !wait.IsZero() {
+				retry = time.After(time.Until(wait))
+			}
+			idle, keepalive := w.idletimers()
 			select {
 			case <-u.queue.ch:
 				// no op
-			case <-time.After(60 * time.Second):
-				u.disconnect(nil)
+			case <-retry:
+				// no op
+			case <-idle:
+				w.disconnect(nil)
+			case <-keepalive:
+				w.sendkeepalive()
 			case <-u.chquit:
 				return
 			}
@@ -283,6 +939,81 @@ func (u *Uploader) run() {
 	}
 }
 
+// permanent reports if the destination failed to store
+// a file with err because of the file itself.
+func (w *worker) permanent(err error) bool {
+	c, ok := w.dest.(Classifier)
+	return ok && c.Permanent(err)
+}
+
+// touch records that the connection has been used.
+func (w *worker) touch() {
+	w.used = time.Now()
+	w.active = w.used
+}
+
+// idletimers returns the channels signalling when the idle connection
+// is to be closed, and when a keepalive is to be sent, if enabled.
+func (w *worker) idletimers() (disconnect, keepalive <-chan time.Time) {
+	if !w.dest.Connected() {
+		return nil, nil
+	}
+	disconnect = time.After(time.Until(w.used.Add(w.u.disconnectdelay)))
+	if _, ok := w.dest.(Keeper); ok && w.u.keepalive != 0 {
+		keepalive = time.After(time.Until(w.active.Add(w.u.keepalive)))
+	}
+	return
+}
+
+func (w *worker) sendkeepalive() {
+	w.active = time.Now()
+	if err := w.dest.(Keeper).Keepalive(); err != nil {
+		w.log.Println("Keepalive failed:", err)
+		w.disconnect(nil)
+	}
+}
+
+// pause waits until end without starting new uploads.
+func (w *worker) pause(end time.Time) {
+	u := w.u
+	if w == u.workers[0] {
+		u.log.Println("Delivery paused until", end.Format("Mon 15:04"))
+		notifier.notifyall()
+	}
+	for {
+		idle, keepalive := w.idletimers()
+		select {
+		case <-time.After(time.Until(end)):
+			if w == u.workers[0] {
+				u.log.Println("Delivery resumed")
+				notifier.notifyall()
+			}
+			return
+		case <-idle:
+			w.disconnect(nil)
+		case <-keepalive:
+			w.sendkeepalive()
+		case <-u.chquit:
+			return
+		}
+	}
+}
+
+func (w *worker) setcontent(c io.Closer) {
+	w.cmtx.Lock()
+	defer w.cmtx.Unlock()
+	w.content = c
+}
+
+// abort interrupts the upload in progress by closing its content.
+func (w *worker) abort() {
+	w.cmtx.Lock()
+	defer w.cmtx.Unlock()
+	if w.content != nil {
+		w.content.Close()
+	}
+}
+
 func Encodename(x string) (string, error) {
 	return idna.ToASCII(strings.ToLower(x))
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func newtestcache(t *testing.T) *CacheDir {
+	d, err := OpenCacheDir("", CacheOptions{Path: t.TempDir(), MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func newtestuploader(t *testing.T, c DestConfig) *Uploader {
+	c.FailDelay, c.ReconnectDelay = "10ms", "10ms"
+	u, err := NewUploader(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		u.Shutdown(ctx)
+	})
+	return u
+}
+
+// waitfor polls cond until it is true, failing after a few seconds.
+func waitfor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func cachedfiles(d *CacheDir, user string) int {
+	cached, partial := d.Userfiles(user)
+	return len(cached) + len(partial)
+}
+
+func TestUploadToLocalDir(t *testing.T) {
+	d, dest := newtestcache(t), t.TempDir()
+	u := newtestuploader(t, DestConfig{URL: "file://" + filepath.ToSlash(dest)})
+	f, err := d.Add("John", "a.txt", "en", "127.0.0.1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.Add(f); err != nil {
+		t.Fatal(err)
+	}
+	waitfor(t, "discard", func() bool { return cachedfiles(d, "john") == 0 })
+	b, err := ioutil.ReadFile(filepath.Join(dest, "uplood-john", "a.txt"))
+	if err != nil || string(b) != "hello" {
+		t.Errorf("delivered %q, %v, want hello", b, err)
+	}
+	if n := d.Size(); n != 0 {
+		t.Errorf("%d bytes left in the cache", n)
+	}
+	fis, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() != filepath.Base(d.datafilename()) {
+			t.Errorf("%s left in the cache directory", fi.Name())
+		}
+	}
+}
+
+func TestManifestRetry(t *testing.T) {
+	d, dest := newtestcache(t), t.TempDir()
+	userdir := filepath.Join(dest, "uplood-john")
+	if err := os.Mkdir(userdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// a manifest that can't be read is not overwritten
+	mname := filepath.Join(userdir, "manifest.json")
+	if err := ioutil.WriteFile(mname, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u := newtestuploader(t, DestConfig{URL: "file://" + filepath.ToSlash(dest), Manifest: MANIFEST_JSON})
+	f, err := d.Add("John", "a.txt", "en", "127.0.0.1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Add(f)
+	waitfor(t, "upload", func() bool {
+		_, err := os.Stat(filepath.Join(userdir, "a.txt"))
+		return err == nil
+	})
+	time.Sleep(100 * time.Millisecond)
+	if cachedfiles(d, "john") != 1 {
+		t.Fatal("file discarded without manifest")
+	}
+	os.Remove(mname)
+	waitfor(t, "discard", func() bool { return cachedfiles(d, "john") == 0 })
+	b, err := ioutil.ReadFile(mname)
+	if err != nil || !strings.Contains(string(b), `"a.txt"`) {
+		t.Errorf("manifest %s, %v", b, err)
+	}
+	names, err := ioutil.ReadDir(userdir)
+	if err != nil || len(names) != 2 {
+		t.Errorf("%d files in the user directory, want 2: %v", len(names), err)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	d, dest := newtestcache(t), t.TempDir()
+	// the user directory can't be created
+	if err := ioutil.WriteFile(filepath.Join(dest, "uplood-john"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	u := newtestuploader(t, DestConfig{URL: "file://" + filepath.ToSlash(dest), MaxAttempts: 3})
+	f, err := d.Add("John", "a.txt", "en", "127.0.0.1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Add(f)
+	waitfor(t, "dead letter", func() bool { return len(u.Deadletters()) == 1 })
+	u.queue.mtx.Lock()
+	n := u.queue.size
+	u.queue.mtx.Unlock()
+	if n != 0 {
+		t.Error("dead letter still queued")
+	}
+	if cachedfiles(d, "john") != 1 {
+		t.Error("dead letter not kept in the cache")
+	}
+}
+
+// uploadtest adds a file for John to the cache and waits for u to
+// deliver or skip it.
+func uploadtest(t *testing.T, d *CacheDir, u *Uploader, fn, lang, content string) {
+	f, err := d.Add("John", fn, lang, "127.0.0.1", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.Add(f); err != nil {
+		t.Fatal(err)
+	}
+	waitfor(t, "discard of "+fn, func() bool { return cachedfiles(d, "john") == 0 })
+}
+
+// remotefiles returns the files below dir as path=content.
+func remotefiles(t *testing.T, dir string) string {
+	var v []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		rel, _ := filepath.Rel(dir, p)
+		v = append(v, filepath.ToSlash(rel)+"="+string(b))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(v, " ")
+}
+
+func TestCollision(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{COLLISION_OVERWRITE, "john/de/a.txt=3 john/en/a.txt=2"},
+		{COLLISION_SKIP, "john/de/a.txt=3 john/en/a.txt=1"},
+		{COLLISION_RENAME, "john/de/a.txt=3 john/en/a-1.txt=2 john/en/a.txt=1"},
+	} {
+		d, dest := newtestcache(t), t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dest, "john", "en"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dest, "john", "en", "a.txt"), []byte("1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		u := newtestuploader(t, DestConfig{URL: "file://" + filepath.ToSlash(dest), Layout: "{user}/{lang}", Collision: tc.policy})
+		uploadtest(t, d, u, "a.txt", "en", "2")
+		// a file of the user in another directory is no collision
+		uploadtest(t, d, u, "a.txt", "de", "3")
+		if got := remotefiles(t, dest); got != tc.want {
+			t.Errorf("%s: remote files %s, want %s", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestSkipDuplicates(t *testing.T) {
+	d, dest := newtestcache(t), t.TempDir()
+	u := newtestuploader(t, DestConfig{URL: "file://" + filepath.ToSlash(dest), SkipDuplicates: true})
+	uploadtest(t, d, u, "a.txt", "en", "hello")
+	uploadtest(t, d, u, "b.txt", "en", "hello")
+	uploadtest(t, d, u, "c.txt", "en", "other")
+	if got, want := remotefiles(t, dest), "uplood-john/a.txt=hello uplood-john/c.txt=other"; got != want {
+		t.Errorf("remote files %s, want %s", got, want)
+	}
+	// the content is sent again once removed from the remote side
+	if err := os.Remove(filepath.Join(dest, "uplood-john", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	uploadtest(t, d, u, "d.txt", "en", "hello")
+	if got, want := remotefiles(t, dest), "uplood-john/c.txt=other uplood-john/d.txt=hello"; got != want {
+		t.Errorf("remote files %s, want %s", got, want)
+	}
+}
+
+func TestManifestEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, dest := newtestcache(t), t.TempDir()
+	u := newtestuploader(t, DestConfig{URL: "file://" + filepath.ToSlash(dest), Manifest: MANIFEST_JSON,
+		AgeRecipients: []string{id.Recipient().String()}})
+	u.tmp = d
+	uploadtest(t, d, u, "a.txt", "en", "hello")
+	b, err := ioutil.ReadFile(filepath.Join(dest, "uplood-john", "a.txt.age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	p, err := ioutil.ReadFile(filepath.Join(dest, "uplood-john", "manifest.json"))
+	if err == nil {
+		err = json.Unmarshal(p, &m)
+	}
+	if err != nil || len(m.Files) != 1 {
+		t.Fatalf("manifest %s, %v", p, err)
+	}
+	sum := sha256.Sum256(b)
+	orig := sha256.Sum256([]byte("hello"))
+	e := m.Files[0]
+	if e.Name != "a.txt.age" || e.Size != int64(len(b)) || e.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("entry %+v, want the encrypted file of %d bytes", e, len(b))
+	}
+	if e.OriginalSize != 5 || e.OriginalSHA256 != hex.EncodeToString(orig[:]) {
+		t.Errorf("original content %d %s, want 5 %x", e.OriginalSize, e.OriginalSHA256, orig)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the free space of the disk of a volume is checked again after this
+// time, meanwhile the bytes written to the volume are subtracted
+const VOLUME_FREE_REFRESH = 5 * time.Second
+
+// CacheVolume is an additional directory for cached files,
+// eg. on another disk.
+type CacheVolume struct {
+	Path    string
+	MaxSize string // eg. "100G", limited only by MaxCacheSize if empty
+}
+
+// cachevolume is a directory holding cached content.
+type cachevolume struct {
+	path    string
+	maxsize int64 // 0 if unlimited
+	size    int64
+	free    int64     // free bytes on the disk at freeat
+	freeat  time.Time // zero if free is unknown
+	freesiz int64     // size at freeat
+}
+
+func newcachevolume(path string, maxsize int64) (*cachevolume, error) {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(p, 0700); err != nil {
+		return nil, err
+	}
+	return &cachevolume{path: p, maxsize: maxsize}, nil
+}
+
+// room returns the bytes that can be stored on v, keeping minfree
+// bytes free on its disk. Must be called with d.mtx held.
+func (d *CacheDir) room(v *cachevolume) int64 {
+	n := d.MaxSize - d.size
+	if v.maxsize > 0 && v.maxsize-v.size < n {
+		n = v.maxsize - v.size
+	}
+	if time.Since(v.freeat) >= VOLUME_FREE_REFRESH {
+		free, err := diskfree(v.path)
+		if err != nil {
+			d.log.Println("Can't get free space of", v.path+":", err)
+			v.freeat = time.Time{}
+			return n
+		}
+		v.free, v.freeat, v.freesiz = free, time.Now(), v.size
+	}
+	if free := v.free - (v.size - v.freesiz); free-d.minfree < n {
+		n = free - d.minfree
+	}
+	return n
+}
+
+// templimiter allocates disk space for temporary files in Path, like
+// the encrypted copies of destinations. They don't count against
+// MaxSize, so a full cache can't block their delivery, but MinFree
+// bytes are kept free on the disk.
+type templimiter struct {
+	d *CacheDir
+}
+
+func (l templimiter) AllocBytes(n int) bool {
+	d := l.d
+	free, err := diskfree(d.Path)
+	if err != nil {
+		// writing fails if the disk is full
+		return true
+	}
+	if free-int64(n) < d.minfree {
+		d.log.Println("disk of", d.Path, "full: couldn't allocate", n, "bytes")
+		return false
+	}
+	return true
+}
+
+func (l templimiter) FreeBytes(n int) {}
+
+// choosevolume returns the volume with the most room for new content.
+func (d *CacheDir) choosevolume() *cachevolume {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	best, bestroom := d.volumes[0], d.room(d.volumes[0])
+	for _, v := range d.volumes[1:] {
+		if n := d.room(v); n > bestroom {
+			best, bestroom = v, n
+		}
+	}
+	return best
+}
+
+// volumeof returns the volume of the cached file fn, or nil if
+// it is in a directory no longer used.
+func (d *CacheDir) volumeof(fn string) *cachevolume {
+	dir := filepath.Dir(fn)
+	for _, v := range d.volumes {
+		if v.path == dir {
+			return v
+		}
+	}
+	return nil
+}
+
+// addsize adds n bytes to the size of the cache, and
+// of the volume of fn. Must be called with d.mtx held.
+func (d *CacheDir) addsize(fn string, n int64) {
+	d.size += n
+	if v := d.volumeof(fn); v != nil {
+		v.size += n
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// opentestvolumes opens a cache with a volume of each maxsize
+// besides Path, all on disks with free bytes.
+func opentestvolumes(t *testing.T, minfree, free int64, maxsize ...int64) *CacheDir {
+	opt := CacheOptions{Path: t.TempDir(), MaxSize: 1 << 30, MinFree: minfree}
+	for _, n := range maxsize {
+		v, err := newcachevolume(t.TempDir(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt.Volumes = append(opt.Volumes, v)
+	}
+	d, err := OpenCacheDir("", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	for _, v := range d.volumes {
+		setfree(v, free)
+	}
+	return d
+}
+
+// setfree sets the free space of the disk of v, as if just checked.
+func setfree(v *cachevolume, free int64) {
+	v.free, v.freeat, v.freesiz = free, time.Now(), v.size
+}
+
+func TestChooseVolume(t *testing.T) {
+	d := opentestvolumes(t, 0, 1<<30, 0, 1000)
+	setfree(d.volumes[1], 2000)
+	if v := d.choosevolume(); v != d.volumes[0] {
+		t.Errorf("chose %s, want the disk with the most free space", v.path)
+	}
+	setfree(d.volumes[0], 500)
+	if v := d.choosevolume(); v != d.volumes[1] {
+		t.Errorf("chose %s, want the second volume", v.path)
+	}
+	// the maximum size of the third volume is not reached
+	setfree(d.volumes[1], 800)
+	if v := d.choosevolume(); v != d.volumes[2] {
+		t.Errorf("chose %s, want the third volume", v.path)
+	}
+	d.volumes[2].size = 300
+	if v := d.choosevolume(); v != d.volumes[1] {
+		t.Errorf("chose %s, want the second volume after the third filled up", v.path)
+	}
+}
+
+func TestVolumeMinFree(t *testing.T) {
+	d := opentestvolumes(t, 1000, 2000)
+	v := d.volumes[0]
+	for _, tc := range []struct {
+		n  int
+		ok bool
+	}{
+		{600, true},
+		// bytes written since the disk was checked are not free
+		{401, false},
+		{400, true},
+		{1, false},
+	} {
+		d.mtx.Lock()
+		ok := d.allocbytes(v, tc.n)
+		d.mtx.Unlock()
+		if ok != tc.ok {
+			t.Errorf("allocating %d bytes with %d used: %v, want %v", tc.n, v.size, ok, tc.ok)
+		}
+	}
+	if v.size != 1000 || d.size != 1000 {
+		t.Errorf("volume size %d, cache size %d, want 1000", v.size, d.size)
+	}
+	// checked again once outdated
+	v.freeat = time.Now().Add(-VOLUME_FREE_REFRESH)
+	d.mtx.Lock()
+	n := d.room(v)
+	d.mtx.Unlock()
+	if !v.freeat.After(time.Now().Add(-time.Second)) || v.free == 2000 || v.freesiz != 1000 {
+		t.Errorf("free space not refreshed: room %d, free %d", n, v.free)
+	}
+}
+
+func TestVolumeMaxSize(t *testing.T) {
+	d := opentestvolumes(t, 0, 1<<30, 15)
+	setfree(d.volumes[0], 12)
+	var dirs []string
+	for _, s := range []string{"0123456789", "abcdef"} {
+		f, err := d.Add("john", "f", "en", "", strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := "home"
+		if filepath.Dir(f.(*CacheEntry).Cn) == d.volumes[1].path {
+			dir = "volume"
+		}
+		dirs = append(dirs, dir)
+	}
+	// the volume has the most room until it holds 10 bytes
+	if got := strings.Join(dirs, " "); got != "volume home" {
+		t.Errorf("files stored in %s, want volume home", got)
+	}
+	if d.volumes[1].size != 10 || d.volumes[0].size != 6 {
+		t.Errorf("volume sizes %d, %d, want 10, 6", d.volumes[1].size, d.volumes[0].size)
+	}
+	if _, err := d.Add("john", "g", "en", "", strings.NewReader("0123456789")); err == nil {
+		t.Error("file stored beyond the room of the volumes")
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,7 +19,16 @@ type WebServer struct {
 	*http.ServeMux
 	Prefix   string
 	Sessions map[string]string
+	Operator *http.ServeMux // pages for operators, on their own listener
+
+	// reverse proxies whose X-Forwarded-For and X-Real-IP are used,
+	// requests on a unix socket are always trusted
+	TrustedProxies []*net.IPNet
+
+	db       *journal // sessions, nil if they can't be stored
 	log      *log.Logger
+	chquit   chan bool
+	quitonce sync.Once
 }
 
 func NewWebServer(p, ext string) *WebServer {
@@ -21,7 +36,9 @@ func NewWebServer(p, ext string) *WebServer {
 		ServeMux: http.NewServeMux(),
 		Prefix:   p,
 		Sessions: make(map[string]string),
+		Operator: http.NewServeMux(),
 		log:      log.New(os.Stderr, "WWW     ", log.LstdFlags),
+		chquit:   make(chan bool),
 	}
 	s.load()
 	if len(s.Prefix) != 0 && s.Prefix[len(s.Prefix)-1] != '/' {
@@ -38,6 +55,8 @@ func NewWebServer(p, ext string) *WebServer {
 	s.HandleFunc(s.Prefix+"ws", s.handleSocket)
 	s.HandleFunc(s.Prefix+"upload", s.handleUpload)
 	s.Handle(s.Prefix+"ext/", http.StripPrefix(s.Prefix+"ext/", http.FileServer(http.Dir(ext))))
+	s.Operator.HandleFunc("/status", s.handleStatus)
+	s.Operator.HandleFunc("/deadletters", s.handleDeadletters)
 	return s
 }
 
@@ -46,6 +65,23 @@ func (s *WebServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.ServeMux.ServeHTTP(w, req)
 }
 
+// Close makes the server refuse new uploads.
+func (s *WebServer) Close() error {
+	s.quitonce.Do(func() {
+		close(s.chquit)
+	})
+	return nil
+}
+
+func (s *WebServer) closing() bool {
+	select {
+	case <-s.chquit:
+		return true
+	default:
+	}
+	return false
+}
+
 func (s *WebServer) handleHome(w http.ResponseWriter, req *http.Request) {
 	user := req.FormValue("name")
 	if user != "" {
@@ -59,7 +95,7 @@ func (s *WebServer) handleHome(w http.ResponseWriter, req *http.Request) {
 		// clear query from URL (req.Method == "GET") and make reload
 		// possible without "confirm form resubmission" (req.Method == "POST")
 		http.Redirect(w, req, t, http.StatusMovedPermanently)
-		s.save()
+		s.savesession(sid, user)
 		return
 	}
 	s.showPage(w, req)
@@ -68,11 +104,16 @@ func (s *WebServer) handleHome(w http.ResponseWriter, req *http.Request) {
 func (s *WebServer) handleLogin(w http.ResponseWriter, req *http.Request) {
 	if ck, err := req.Cookie("sid"); err == nil {
 		delete(s.Sessions, ck.Value)
+		s.savesession(ck.Value, "")
 	}
 	s.showPage(w, req)
 }
 
 func (s *WebServer) handleUpload(w http.ResponseWriter, req *http.Request) {
+	if s.closing() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	var user string
 	if ck, err := req.Cookie("sid"); err == nil {
 		user = s.Sessions[ck.Value]
@@ -86,13 +127,17 @@ func (s *WebServer) handleUpload(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Missing file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	cached, err := cachedir.Add(user, fh.Filename, f)
+	cached, err := cachedir.Add(user, fh.Filename, string(Selectlang(req, "lang", languages)), s.remoteaddr(req), f)
 	if err == nil {
-		err = uploader.Add(cached)
+		err = delivery.Add(cached)
 		if err != nil {
 			cached.Discard()
 		}
 	}
+	if qe, ok := err.(*QuotaError); ok {
+		http.Error(w, quotamessage(req, qe), quotastatus(qe))
+		return
+	}
 	if err != nil {
 		http.Error(w, "Upload error: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -100,6 +145,75 @@ func (s *WebServer) handleUpload(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+var quotatemplates = map[string]string{
+	QUOTA_CACHE: "msgQuotaCache",
+	QUOTA_FILES: "msgQuotaFiles",
+	QUOTA_DAILY: "msgQuotaDaily",
+}
+
+// quotastatus returns the HTTP status for an upload refused with e.
+// Retrying later may help with the files and daily limits.
+func quotastatus(e *QuotaError) int {
+	if e.Limit == QUOTA_CACHE {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusTooManyRequests
+}
+
+// quotamessage returns the message of e in the language of req.
+func quotamessage(req *http.Request, e *QuotaError) string {
+	t := selecttemplate(req)
+	if t == nil {
+		return e.Error()
+	}
+	var buf bytes.Buffer
+	if err := t.Home.ExecuteTemplate(&buf, quotatemplates[e.Limit], e.Max); err != nil {
+		log.Println("Quota message:", err)
+		return e.Error()
+	}
+	return buf.String()
+}
+
+// handleStatus shows the connection state of destinations for operators.
+func (s *WebServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, st := range delivery.Status() {
+		fmt.Fprintf(w, "%s, since %s\n", st, st.Since.Format(time.RFC3339))
+	}
+}
+
+// handleDeadletters lists files that failed permanently for operators.
+// POST with action=retry or action=drop, the id and optionally
+// the dest of the file retries or drops the file.
+func (s *WebServer) handleDeadletters(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+	case "POST":
+		var err error
+		dest, id := req.FormValue("dest"), req.FormValue("id")
+		switch req.FormValue("action") {
+		case "retry":
+			err = delivery.Retry(dest, id)
+		case "drop":
+			err = delivery.Drop(dest, id)
+		default:
+			err = fmt.Errorf("invalid action")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, dl := range delivery.Deadletters() {
+		fmt.Fprintf(w, "%s\t%s\t%s/%s\t%s\n", dl.Dest, dl.File.ID(), dl.File.User(), dl.File.Filename(), dl.Reason)
+	}
+}
+
 func (s *WebServer) handleSocket(w http.ResponseWriter, req *http.Request) {
 	var user string
 	if ck, err := req.Cookie("sid"); err == nil {
@@ -110,44 +224,126 @@ func (s *WebServer) handleSocket(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// remoteaddr returns the IP address of the client. If the request
+// comes from a trusted reverse proxy, the address it sets in
+// X-Forwarded-For or X-Real-IP is used.
+func (s *WebServer) remoteaddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// unix socket, only local proxies can connect
+		host = ""
+	} else if !s.trusted(host) {
+		return host
+	}
+	if v := req.Header.Get("X-Forwarded-For"); v != "" {
+		// the last address not added by a trusted proxy
+		addrs := strings.Split(v, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			a := strings.TrimSpace(addrs[i])
+			if i == 0 || !s.trusted(a) {
+				return a
+			}
+		}
+	}
+	if v := req.Header.Get("X-Real-IP"); v != "" {
+		return v
+	}
+	if host == "" {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// trusted reports if addr is a trusted reverse proxy.
+func (s *WebServer) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func selecttemplate(req *http.Request) *tmpl {
 	l := Selectlang(req, "lang", languages)
 	return langtmpl[l]
 }
 
 func (s *WebServer) load() {
-	f, err := os.Open(s.datafilename())
-	switch {
-	case err == nil:
-		defer f.Close()
-		err = gob.NewDecoder(f).Decode(&s.Sessions)
-	case os.IsNotExist(err):
-		err = nil
+	var err error
+	if s.db, err = openjournal(s.datafilename(), s.log); err != nil {
+		s.log.Println("Load error:", err)
+		return
 	}
-	if err != nil {
+	if err = s.importsessions(); err != nil {
 		s.log.Println("Load error:", err)
 	}
+	s.db.each(func(sid string, val json.RawMessage) {
+		var user string
+		if err := json.Unmarshal(val, &user); err == nil {
+			s.Sessions[sid] = user
+		}
+	})
 }
 
-func (s *WebServer) save() {
-	f, err := SafeFileWriter(s.datafilename())
-	if err == nil {
-		defer func() {
-			err = f.Close()
-			if err != nil {
-				s.log.Println("Can't close:", err)
-			}
-		}()
-		err = gob.NewEncoder(f).Encode(s.Sessions)
+// importsessions moves the sessions from the session.dat
+// of earlier versions into the journal.
+func (s *WebServer) importsessions() error {
+	fn := cachedir.Path + "/session.dat"
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sessions map[string]string
+	err = gob.NewDecoder(f).Decode(&sessions)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for sid, user := range sessions {
+		if err = s.db.put(sid, user); err != nil {
+			return err
+		}
+	}
+	return os.Remove(fn)
+}
+
+// savesession stores the user of session sid, or
+// removes the session if user is empty.
+func (s *WebServer) savesession(sid, user string) {
+	if s.db == nil {
+		return
+	}
+	var err error
+	if user != "" {
+		err = s.db.put(sid, user)
+	} else {
+		err = s.db.delete(sid)
 	}
 	if err != nil {
 		s.log.Println("Can't save:", err)
 	}
 }
 
+// closesessions closes the session store.
+func (s *WebServer) closesessions() {
+	if s.db == nil {
+		return
+	}
+	if err := s.db.close(); err != nil {
+		s.log.Println("Can't close:", err)
+	}
+}
+
 func (s *WebServer) datafilename() string {
-	p, _ := GetCacheDir("")
-	return p + "/session.dat"
+	return cachedir.Path + "/sessions.journal"
 }
 
 type page struct {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	nets, err := parsenets([]string{"10.0.0.1", "192.168.0.0/16", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &WebServer{TrustedProxies: nets}
+	for _, tc := range []struct {
+		remote, xff, xrealip string
+		want                 string
+	}{
+		{"203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "192.168.1.2, 192.168.1.1", "", "192.168.1.2"},
+		{"[::1]:1234", "2001:db8::1", "", "2001:db8::1"},
+		{"10.0.0.2:1234", "198.51.100.1", "", "10.0.0.2"},
+		{"@", "198.51.100.1", "", "198.51.100.1"},
+		{"@", "", "", "@"},
+	} {
+		req := &http.Request{RemoteAddr: tc.remote, Header: make(http.Header)}
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.xrealip != "" {
+			req.Header.Set("X-Real-IP", tc.xrealip)
+		}
+		if got := s.remoteaddr(req); got != tc.want {
+			t.Errorf("%s, X-Forwarded-For %q, X-Real-IP %q: got %s, want %s", tc.remote, tc.xff, tc.xrealip, got, tc.want)
+		}
+	}
+	if _, err = parsenets([]string{"10.0.0"}); err == nil {
+		t.Error("invalid address accepted")
+	}
+}
+
+func TestImportSessions(t *testing.T) {
+	cachedir = newtestcache(t)
+	defer func() { cachedir = nil }()
+	f, err := os.Create(cachedir.Path + "/session.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(f).Encode(map[string]string{"s1": "john", "s2": "anna"})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		s := &WebServer{Sessions: make(map[string]string), log: cachedir.log}
+		s.load()
+		if len(s.Sessions) != 2 || s.Sessions["s1"] != "john" || s.Sessions["s2"] != "anna" {
+			t.Errorf("open %d: sessions %v", i, s.Sessions)
+		}
+		s.closesessions()
+		if _, err = os.Stat(cachedir.Path + "/session.dat"); !os.IsNotExist(err) {
+			t.Error("session.dat not removed:", err)
+		}
+	}
+}
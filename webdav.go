@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// webdavDestination stores files on a WebDAV share, such as Nextcloud.
+type webdavDestination struct {
+	Root string
+
+	log       *log.Logger
+	client    *gowebdav.Client
+	connected bool
+}
+
+func newWebDAVDestination(u *url.URL, c DestConfig, l *log.Logger) (*webdavDestination, error) {
+	root := url.URL{Host: u.Host, Path: u.Path}
+	switch u.Scheme {
+	case "dav":
+		root.Scheme = "http"
+	case "davs":
+		root.Scheme = "https"
+	}
+	// basic or digest auth, depending on the server
+	user, pass := urlcredentials(u, "")
+	client := gowebdav.NewClient(root.String(), user, pass)
+	if root.Scheme == "https" {
+		cfg, err := tlsconfig(c, u.Hostname(), l)
+		if err != nil {
+			return nil, err
+		}
+		client.SetTransport(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: cfg,
+		})
+	}
+	return &webdavDestination{
+		Root:   root.String(),
+		log:    l,
+		client: client,
+	}, nil
+}
+
+func (d *webdavDestination) Connect() error {
+	err := d.client.Connect()
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = d.client.Stat("/"); err == nil && !fi.IsDir() {
+			err = fmt.Errorf("%s is not a collection", d.Root)
+		}
+	}
+	if err != nil {
+		d.log.Println("Connection failed:", err)
+		return err
+	}
+	d.connected = true
+	return nil
+}
+
+func (d *webdavDestination) Disconnect() error {
+	d.connected = false
+	return nil
+}
+
+func (d *webdavDestination) Connected() bool {
+	return d.connected
+}
+
+func (d *webdavDestination) Store(userdir, filename string, r io.Reader, size int64) error {
+	errmk := d.client.MkdirAll(userdir, 0755) // MKCOL, fails if it exists
+	if fi, err := d.client.Stat(userdir); err != nil || !fi.IsDir() {
+		d.log.Println("Creating collection", userdir, "failed:", errmk, err)
+		if err == nil {
+			err = fmt.Errorf("%s is not a collection", userdir)
+		}
+		return err
+	}
+	return d.client.WriteStream(path.Join(userdir, filename), r, 0644)
+}
+
+// Permanent reports if the server refused the PUT of the file
+// as forbidden or too large.
+func (d *webdavDestination) Permanent(err error) bool {
+	var pe *os.PathError
+	if !errors.As(err, &pe) || pe.Op != "WriteStream" {
+		return false
+	}
+	se, ok := pe.Err.(gowebdav.StatusError)
+	return ok && (se.Status == http.StatusForbidden || se.Status == http.StatusRequestEntityTooLarge)
+}
+
+func (d *webdavDestination) Check(userdir, filename string) (int64, string, error) {
+	fi, err := d.client.Stat(path.Join(userdir, filename))
+	if err != nil {
+		return 0, "", err
+	}
+	return fi.Size(), "", nil
+}
+
+func (d *webdavDestination) Fetch(userdir, filename string) (io.ReadCloser, error) {
+	return d.client.ReadStream(path.Join(userdir, filename))
+}
+
+// Rename uses MOVE with overwrite.
+func (d *webdavDestination) Rename(userdir, from, to string) error {
+	return d.client.Rename(path.Join(userdir, from), path.Join(userdir, to), true)
+}
+
+// List uses PROPFIND to get the entries of dir.
+func (d *webdavDestination) List(dir string) ([]string, error) {
+	if dir == "." {
+		dir = "/"
+	}
+	v, err := d.client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(v))
+	for i, fi := range v {
+		names[i] = fi.Name()
+	}
+	return names, nil
+}
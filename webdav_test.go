@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// newtestwebdavserver serves dir over WebDAV below /dav, with basic
+// auth as john/secret. PUTs of files named forbidden* are refused.
+func newtestwebdavserver(t *testing.T, dir string) string {
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "john" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method == "PUT" && strings.HasPrefix(filepath.Base(req.URL.Path), "forbidden") {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}))
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+func newtestwebdavdest(t *testing.T, rawurl string) *webdavDestination {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newWebDAVDestination(u, DestConfig{}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestWebDAVDestination(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "incoming"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	host := newtestwebdavserver(t, dir)
+	d := newtestwebdavdest(t, "dav://john:secret@"+host+"/dav/incoming")
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Store("uplood-john", "a.txt", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	// the collection exists already
+	if err := d.Store("uplood-john", "b.txt", strings.NewReader("hi"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "incoming", "uplood-john", "a.txt")); err != nil || string(b) != "hello" {
+		t.Errorf("stored %q, %v, want hello", b, err)
+	}
+	if size, _, err := d.Check("uplood-john", "a.txt"); err != nil || size != 5 {
+		t.Errorf("Check = %d, %v, want 5", size, err)
+	}
+	if _, _, err := d.Check("uplood-john", "missing"); err == nil {
+		t.Error("Check of a missing file succeeded")
+	}
+	names, err := d.List("uplood-john")
+	sort.Strings(names) // in the order of the server
+	if err != nil || strings.Join(names, " ") != "a.txt b.txt" {
+		t.Errorf("List = %v, %v, want [a.txt b.txt]", names, err)
+	}
+	if names, err = d.List("."); err != nil || strings.Join(names, " ") != "uplood-john" {
+		t.Errorf("List(.) = %v, %v, want [uplood-john]", names, err)
+	}
+	if err = d.Rename("uplood-john", "b.txt", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := d.Fetch("uplood-john", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != "hi" {
+		t.Errorf("fetched %q, %v, want hi after rename", b, err)
+	}
+	err = d.Store("uplood-john", "forbidden.txt", strings.NewReader("x"), 1)
+	if err == nil || !d.Permanent(err) {
+		t.Errorf("refused PUT: %v, permanent %v", err, err != nil && d.Permanent(err))
+	}
+}
+
+func TestWebDAVConnect(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	host := newtestwebdavserver(t, dir)
+	for _, rawurl := range []string{
+		"dav://john:wrong@" + host + "/dav/",
+		"dav://john:secret@" + host + "/dav/file",
+		"dav://john:secret@" + host + "/dav/missing",
+	} {
+		if err := newtestwebdavdest(t, rawurl).Connect(); err == nil {
+			t.Errorf("%s: connected", rawurl)
+		}
+	}
+}